@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// execCommand selects roles and replaces talcum with a command that
+// finds the roles in its environment, so that signals reach the
+// command directly. The slots are not renewed or released, so
+// expiring locks should be used with runCommand instead.
+func execCommand(args []string, logger *log.Logger) {
+	var opts selectOptions
+	flags := newSelectFlagSet("exec", &opts)
+	flags.Parse(args)
+	opts.checkOneShot("exec")
+
+	clierr := func(msg string, params ...interface{}) {
+		fmt.Fprintf(os.Stderr, msg+"\n", params...)
+		os.Exit(1)
+	}
+
+	command := flags.Args()
+	if len(command) == 0 {
+		clierr("usage: talcum exec [flags] -- command [args...]")
+	}
+	path, err := exec.LookPath(command[0])
+	if err != nil {
+		clierr("%v", err)
+	}
+	if opts.backend == "zookeeper" && opts.members == "" && opts.membersPath == "" {
+		logger.Printf("warning: zookeeper locks are ephemeral and are released when talcum execs, use talcum run to hold them")
+	}
+
+	_, _, selections := opts.selectRoles(logger, nil)
+
+	env := append(os.Environ(), roleEnv(&opts.config, selections)...)
+	if err := syscall.Exec(path, command, env); err != nil {
+		clierr("error executing command: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -15,103 +16,263 @@ import (
 	"math/rand"
 
 	"github.com/dollarshaveclub/talcum/src/talcum"
+	"github.com/go-zookeeper/zk"
+	"github.com/gomodule/redigo/redis"
 	"github.com/hashicorp/consul/api"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
-func selectRandom(selectorConfig talcum.SelectorConfig, config *talcum.Config) *talcum.SelectorEntry {
-	selector := talcum.NewSelector(config, selectorConfig, nil)
-	return selector.SelectRandom()
-}
+// options contains the flags shared by all commands.
+type options struct {
+	backend                  string
+	selectorConfigConsulPath string
+	selectorConfigPath       string
+	config                   talcum.Config
+	consulHost               string
+	consulSession            bool
+	consulSessionChecks      string
+	sessionConfig            talcum.ConsulSessionConfig
+	etcdEndpoints            string
+	etcdLeaseTTL             time.Duration
+	redisAddr                string
+	redisDB                  int
+	redisPassword            string
+	redisTLS                 bool
+	redisTTL                 time.Duration
+	lockDir                  string
+	zkServers                string
+	zkRoot                   string
+	zkSessionTimeout         time.Duration
+	k8sNamespace             string
+	k8sLeaseDuration         time.Duration
+	sqlDriver                string
+	sqlDSN                   string
+	sqlTTL                   time.Duration
+	selectionIDFromConfig    bool
+	deployID                 string
 
-func main() {
-	logger := log.New(os.Stderr, "", log.LstdFlags)
+	consulClient *api.Client
+}
 
-	seed, err := crand.Int(crand.Reader, big.NewInt(100000))
-	if err != nil {
-		logger.Printf("Error generating random seed: %s", err)
-	}
-	rand.Seed(seed.Int64())
+func newFlagSet(name string, opts *options) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.StringVar(&opts.backend, "backend", "consul", "the locking backend (consul, etcd, redis, zookeeper, kubernetes, sql or file)")
+	flags.StringVar(&opts.selectorConfigConsulPath, "consul-path", "", "the path to the role configuration in Consul")
+	flags.StringVar(&opts.selectorConfigPath, "config-path", "", "the path to the role configuration file")
+	flags.StringVar(&opts.consulHost, "consul-host", "localhost:8500", "the location of Consul")
+	flags.BoolVar(&opts.consulSession, "consul-session", false, "hold locks with a Consul session so they are deleted when the session is invalidated")
+	flags.DurationVar(&opts.sessionConfig.TTL, "consul-session-ttl", 0, "the TTL of the Consul session, renewed by talcum run (locks are deleted unless the session is renewed)")
+	flags.StringVar(&opts.consulSessionChecks, "consul-session-checks", "serfHealth", "the health checks the Consul session is tied to (comma-delimited)")
+	flags.StringVar(&opts.etcdEndpoints, "etcd-endpoints", "http://localhost:2379", "the etcd endpoints (comma-delimited)")
+	flags.DurationVar(&opts.etcdLeaseTTL, "etcd-lease-ttl", 0, "the TTL of the etcd lease locks are attached to (locks are deleted unless the lease is renewed)")
+	flags.StringVar(&opts.redisAddr, "redis-addr", "localhost:6379", "the address of Redis")
+	flags.IntVar(&opts.redisDB, "redis-db", 0, "the Redis database")
+	flags.StringVar(&opts.redisPassword, "redis-password", "", "the Redis password")
+	flags.BoolVar(&opts.redisTLS, "redis-tls", false, "connect to Redis using TLS")
+	flags.DurationVar(&opts.redisTTL, "redis-ttl", 0, "the expiry of Redis locks (locks are deleted unless they are renewed)")
+	flags.StringVar(&opts.lockDir, "lock-dir", "", "the directory locks are created in (file backend)")
+	flags.StringVar(&opts.zkServers, "zk-servers", "localhost:2181", "the ZooKeeper servers (comma-delimited)")
+	flags.StringVar(&opts.zkRoot, "zk-root", "/talcum", "the ZooKeeper path locks are created under")
+	flags.DurationVar(&opts.zkSessionTimeout, "zk-session-timeout", 10*time.Second, "the ZooKeeper session timeout")
+	flags.StringVar(&opts.k8sNamespace, "k8s-namespace", "", "the Kubernetes namespace Leases are created in (defaults to the namespace of the pod)")
+	flags.DurationVar(&opts.k8sLeaseDuration, "k8s-lease-duration", 0, "the duration of Kubernetes Leases (Leases can be taken over unless they are renewed)")
+	flags.StringVar(&opts.sqlDriver, "sql-driver", "postgres", "the SQL driver (postgres, mysql or sqlite3)")
+	flags.StringVar(&opts.sqlDSN, "sql-dsn", "", "the SQL data source name")
+	flags.DurationVar(&opts.sqlTTL, "sql-ttl", 0, "the expiry of SQL locks (locks can be taken over unless they are renewed)")
+	flags.StringVar(&opts.config.ApplicationName, "app-name", "app", "the name of the current application")
+	flags.StringVar(&opts.config.SelectionID, "selection-id", "1", "the ID of the current selection")
+	flags.BoolVar(&opts.selectionIDFromConfig, "selection-id-from-config", false, "derive the selection ID from a hash of the role configuration instead of -selection-id")
+	flags.StringVar(&opts.deployID, "deploy-id", "", "an ID prepended to the selection ID derived with -selection-id-from-config")
+	flags.StringVar(&opts.config.ActorID, "actor-id", "", "the ID of the current actor (defaults to <hostname>:<pid>)")
+	flags.BoolVar(&opts.config.DebugMode, "debug", false, "run in debug mode")
+	return flags
+}
 
-	var selectorConfigConsulPath string
-	var selectorConfigPath string
-	var config talcum.Config
-	var mconfig talcum.MetricsConfig
-	var consulHost string
-
-	flag.StringVar(&selectorConfigConsulPath, "consul-path", "", "the path to the role configuration in Consul")
-	flag.StringVar(&selectorConfigPath, "config-path", "", "the path to the role configuration file")
-	flag.StringVar(&consulHost, "consul-host", "localhost:8500", "the location of Consul")
-	flag.StringVar(&config.ApplicationName, "app-name", "app", "the name of the current application")
-	flag.StringVar(&config.SelectionID, "selection-id", "1", "the ID of the current selection")
-	flag.BoolVar(&config.DebugMode, "debug", false, "run in debug mode")
-	flag.DurationVar(&config.LockDelay, "lock-delay", 0, "the delay in between lock attempts")
-	flag.StringVar(&mconfig.StatsdAddr, "statsd-addr", "0.0.0.0:8125", "statsd (dogstatsd) address")
-	flag.BoolVar(&mconfig.Datadog, "datadog", true, "statsd is Datadog (dogstatsd)")
-	flag.StringVar(&mconfig.Namespace, "metrics-namespace", "talcum", "Datadog metrics namespace (ignored if not using Datadog)")
-	flag.StringVar(&mconfig.TagStr, "metrics-tags", "production", "Metrics tags (comma-delimited, either datadog <key>:<value> or influxdb <key>=<value>")
-	flag.Parse()
-
-	if mconfig.TagStr != "" {
-		mconfig.Tags = strings.Split(mconfig.TagStr, ",")
+func (opts *options) consul() (*api.Client, error) {
+	if opts.consulClient != nil {
+		return opts.consulClient, nil
 	}
 
-	mc, err := talcum.NewStatsdCollector(&mconfig, logger)
+	consulConfig := api.DefaultConfig()
+	consulConfig.Address = opts.consulHost
+	consulClient, err := api.NewClient(consulConfig)
 	if err != nil {
-		logger.Printf("error initializing datadog collector: %v", err)
+		return nil, fmt.Errorf("consul error: %v", err)
 	}
+	opts.consulClient = consulClient
+	return consulClient, nil
+}
 
-	clierr := func(msg string, params ...interface{}) {
-		mc.RoleError()
-		mc.Flush()
-		fmt.Fprintf(os.Stderr, msg+"\n", params...)
-		os.Exit(1)
+// expiry returns the name and value of the flag that makes the locks
+// of the backend expire unless they are renewed, or an empty name if
+// the locks don't expire.
+func (opts *options) expiry() (string, time.Duration) {
+	switch opts.backend {
+	case "consul":
+		if opts.consulSession && opts.sessionConfig.TTL > 0 {
+			return "-consul-session-ttl", opts.sessionConfig.TTL
+		}
+	case "etcd":
+		if opts.etcdLeaseTTL > 0 {
+			return "-etcd-lease-ttl", opts.etcdLeaseTTL
+		}
+	case "redis":
+		if opts.redisTTL > 0 {
+			return "-redis-ttl", opts.redisTTL
+		}
+	case "kubernetes":
+		if opts.k8sLeaseDuration > 0 {
+			return "-k8s-lease-duration", opts.k8sLeaseDuration
+		}
+	case "sql":
+		if opts.sqlTTL > 0 {
+			return "-sql-ttl", opts.sqlTTL
+		}
 	}
+	return "", 0
+}
 
-	defer mc.Flush()
-	defer mc.TimeToPickRole(time.Now().UTC())
+func (opts *options) locker() (talcum.Locker, error) {
+	switch opts.backend {
+	case "consul":
+		return opts.consulLocker()
+	case "etcd":
+		client := talcum.NewEtcdClient(strings.Split(opts.etcdEndpoints, ","), nil)
+		return talcum.NewEtcdLocker(client, opts.etcdLeaseTTL), nil
+	case "redis":
+		pool := &redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", opts.redisAddr,
+					redis.DialDatabase(opts.redisDB),
+					redis.DialPassword(opts.redisPassword),
+					redis.DialUseTLS(opts.redisTLS))
+			},
+		}
+		return talcum.NewRedisLocker(pool, opts.redisTTL), nil
+	case "zookeeper":
+		conn, _, err := zk.Connect(strings.Split(opts.zkServers, ","), opts.zkSessionTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("zookeeper error: %v", err)
+		}
+		return talcum.NewZooKeeperLocker(conn, opts.zkRoot), nil
+	case "kubernetes":
+		client, err := talcum.NewInClusterKubernetesClient(opts.k8sNamespace)
+		if err != nil {
+			return nil, fmt.Errorf("kubernetes error: %v", err)
+		}
+		actorID := opts.config.ActorID
+		if actorID == "" {
+			actorID = talcum.DefaultActorID()
+		}
+		return talcum.NewKubernetesLocker(client, actorID, opts.k8sLeaseDuration), nil
+	case "sql":
+		db, err := sql.Open(opts.sqlDriver, opts.sqlDSN)
+		if err != nil {
+			return nil, fmt.Errorf("sql error: %v", err)
+		}
+		return talcum.NewSQLLocker(db, opts.sqlDriver, opts.sqlTTL)
+	case "file":
+		if opts.lockDir == "" {
+			return nil, fmt.Errorf("-lock-dir is required by the file backend")
+		}
+		return talcum.NewFileLocker(opts.lockDir), nil
+	default:
+		return nil, fmt.Errorf("unknown backend: %s", opts.backend)
+	}
+}
 
-	consulConfig := api.DefaultConfig()
-	consulConfig.Address = consulHost
-	consulClient, err := api.NewClient(consulConfig)
+func (opts *options) consulLocker() (talcum.Locker, error) {
+	consulClient, err := opts.consul()
 	if err != nil {
-		clierr("consul error: %v", err)
+		return nil, err
 	}
 	kvClient := consulClient.KV()
-	locker := talcum.NewConsulLocker(kvClient)
+	if opts.consulSession {
+		opts.sessionConfig.Name = fmt.Sprintf("talcum-%s-%s", opts.config.ApplicationName, opts.config.SelectionID)
+		if opts.consulSessionChecks != "" {
+			opts.sessionConfig.Checks = strings.Split(opts.consulSessionChecks, ",")
+		}
+		return talcum.NewConsulSessionLocker(kvClient, consulClient.Session(), &opts.sessionConfig), nil
+	}
+	return talcum.NewConsulLocker(kvClient), nil
+}
 
+func (opts *options) selectorConfig() (talcum.SelectorConfig, error) {
 	var selectorConfig talcum.SelectorConfig
-	if selectorConfigPath != "" {
-		f, err := os.Open(selectorConfigPath)
+	if opts.selectorConfigPath != "" {
+		f, err := os.Open(opts.selectorConfigPath)
 		if err != nil {
-			clierr("error opening config: %v", err)
+			return nil, fmt.Errorf("error opening config: %v", err)
 		}
 		defer f.Close()
 		if err := json.NewDecoder(f).Decode(&selectorConfig); err != nil {
-			clierr("error unmarshaling config: %v", err)
+			return nil, fmt.Errorf("error unmarshaling config: %v", err)
+		}
+	} else if opts.selectorConfigConsulPath != "" {
+		consulClient, err := opts.consul()
+		if err != nil {
+			return nil, err
 		}
-	} else if selectorConfigConsulPath != "" {
-		kvPair, _, err := kvClient.Get(selectorConfigConsulPath, nil)
+		kvPair, _, err := consulClient.KV().Get(opts.selectorConfigConsulPath, nil)
 		if err != nil || kvPair == nil {
-			clierr("error reading consul KV or KV is equal to nil: %v", err)
+			return nil, fmt.Errorf("error reading consul KV or KV is equal to nil: %v", err)
 		}
 		if err := json.Unmarshal(kvPair.Value, &selectorConfig); err != nil {
-			clierr("error unmarshaling config: %v", err)
+			return nil, fmt.Errorf("error unmarshaling config: %v", err)
 		}
 	} else {
-		clierr("Selector config not provided")
+		return nil, fmt.Errorf("Selector config not provided")
+	}
+	if err := selectorConfig.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	if opts.selectionIDFromConfig {
+		opts.config.SelectionID = selectorConfig.SelectionID(opts.deployID)
+	}
+	if opts.config.DebugMode {
+		log.Printf("Config hash: %s, selection ID: %s", selectorConfig.Hash(), opts.config.SelectionID)
 	}
+	return selectorConfig, nil
+}
+
+// selectRandom chooses a random role when no slot can be locked,
+// leaving out the roles whose overflow policy forbids duplicating
+// them.
+func selectRandom(selectorConfig talcum.SelectorConfig, config *talcum.Config) *talcum.SelectorEntry {
+	selector := talcum.NewSelector(config, selectorConfig, nil)
+	return selector.SelectDuplicable()
+}
+
+func main() {
+	logger := log.New(os.Stderr, "", log.LstdFlags)
 
-	var entry *talcum.SelectorEntry
-	selector := talcum.NewSelector(&config, selectorConfig, locker)
-	entry, err = selector.Select()
+	seed, err := crand.Int(crand.Reader, big.NewInt(100000))
 	if err != nil {
-		logger.Printf("Error selecting an entry: %s", err)
-		logger.Printf("Selecting random entry")
-		entry = selectRandom(selectorConfig, &config)
-		mc.RandomRoleChosen()
+		logger.Printf("Error generating random seed: %s", err)
 	}
+	rand.Seed(seed.Int64())
 
-	mc.RoleChosen(entry.RoleName)
-	logger.Printf("role: %v", entry.RoleName)
-	fmt.Println(entry.RoleDefinition)
+	// The command defaults to selecting a role so that talcum can
+	// be invoked with flags only.
+	command, args := "select", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "select":
+		selectCommand(args, logger)
+	case "release":
+		releaseCommand(args, logger)
+	case "run":
+		runCommand(args, logger)
+	case "exec":
+		execCommand(args, logger)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s (expected select, release, run or exec)\n", command)
+		os.Exit(2)
+	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/dollarshaveclub/talcum/src/talcum"
+)
+
+// releaseCommand releases slots that were claimed by a previous
+// selection, e.g. from a shutdown hook. With -actor-id, only the slots
+// whose claims were made by that actor are released, optionally
+// narrowed down by -role and -slot. Otherwise -role and -slot name a
+// slot that is released regardless of who holds it.
+func releaseCommand(args []string, logger *log.Logger) {
+	var opts options
+	var roleName string
+	var slot int
+
+	flags := newFlagSet("release", &opts)
+	flags.StringVar(&roleName, "role", "", "the name of the role to release")
+	flags.IntVar(&slot, "slot", -1, "the slot of the role to release")
+	flags.Parse(args)
+
+	clierr := func(msg string, params ...interface{}) {
+		fmt.Fprintf(os.Stderr, msg+"\n", params...)
+		os.Exit(1)
+	}
+
+	if opts.config.ActorID == "" && (roleName == "" || slot < 0) {
+		clierr("-actor-id, or -role and -slot, are required")
+	}
+
+	selectorConfig, err := opts.selectorConfig()
+	if err != nil {
+		clierr("%v", err)
+	}
+
+	locker, err := opts.locker()
+	if err != nil {
+		clierr("%v", err)
+	}
+
+	var entry *talcum.SelectorEntry
+	if roleName != "" {
+		entry = selectorConfig.Entry(roleName)
+		if entry == nil {
+			clierr("role not found: %s", roleName)
+		}
+	}
+
+	selector := talcum.NewSelector(&opts.config, selectorConfig, locker)
+	if opts.config.ActorID == "" {
+		if err := selector.Release(entry, slot); err != nil {
+			clierr("error releasing slot: %v", err)
+		}
+		logger.Printf("released role: %v, slot: %v", roleName, slot)
+		return
+	}
+
+	held, err := selector.Held(opts.config.ActorID)
+	if err != nil {
+		clierr("error finding slots held by %s: %v", opts.config.ActorID, err)
+	}
+	for _, selection := range held {
+		if (entry != nil && selection.Entry != entry) || (slot >= 0 && selection.Slot != slot) {
+			continue
+		}
+		err := selector.ReleaseClaim(selection)
+		if err == talcum.ErrClaimLost {
+			logger.Printf("role: %v, slot: %v was claimed by another actor, leaving it", selection.Entry.RoleName, selection.Slot)
+			continue
+		}
+		if err != nil {
+			clierr("error releasing slot: %v", err)
+		}
+		logger.Printf("released role: %v, slot: %v", selection.Entry.RoleName, selection.Slot)
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dollarshaveclub/talcum/src/talcum"
+)
+
+// roleEnv returns the environment variables that make the selected
+// roles available to a command. If several roles were selected, each
+// variable but TALCUM_SELECTION_ID holds one value per line.
+func roleEnv(config *talcum.Config, selections []*talcum.Selection) []string {
+	var names, definitions, slots, random []string
+	for _, selection := range selections {
+		names = append(names, selection.Entry.RoleName)
+		definitions = append(definitions, selection.Entry.RoleDefinition)
+		slots = append(slots, strconv.Itoa(selection.Slot))
+		random = append(random, strconv.FormatBool(selection.Random()))
+	}
+	return []string{
+		"TALCUM_ROLE_NAME=" + strings.Join(names, "\n"),
+		"TALCUM_ROLE_DEFINITION=" + strings.Join(definitions, "\n"),
+		"TALCUM_SLOT=" + strings.Join(slots, "\n"),
+		"TALCUM_RANDOM_FALLBACK=" + strings.Join(random, "\n"),
+		"TALCUM_SELECTION_ID=" + config.SelectionID,
+	}
+}
+
+// forwardedSignals are the signals that talcum run passes on to its
+// command.
+var forwardedSignals = []os.Signal{
+	syscall.SIGTERM,
+	syscall.SIGINT,
+	syscall.SIGHUP,
+	syscall.SIGQUIT,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+}
+
+// exitCode returns the exit code of talcum for the result of a
+// command, following the shell's convention for commands that were
+// killed by a signal.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 1
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
+}
+
+// Reactions to a lost claim.
+const (
+	onLostKill    = "kill"
+	onLostHook    = "hook"
+	onLostReclaim = "reclaim"
+)
+
+// without returns selections without the given ones.
+func without(selections []*talcum.Selection, lost []*talcum.Selection) []*talcum.Selection {
+	dropped := make(map[*talcum.Selection]bool)
+	for _, selection := range lost {
+		dropped[selection] = true
+	}
+	var kept []*talcum.Selection
+	for _, selection := range selections {
+		if !dropped[selection] {
+			kept = append(kept, selection)
+		}
+	}
+	return kept
+}
+
+// watchClaim sends a selection to lostCh once its claim is lost,
+// retrying after errors until doneCh is closed.
+func watchClaim(selector *talcum.Selector, selection *talcum.Selection, interval time.Duration, lostCh chan *talcum.Selection, doneCh chan struct{}, logger *log.Logger) {
+	for {
+		err := selector.Watch(selection, interval, doneCh)
+		switch err {
+		case nil:
+			return
+		case talcum.ErrClaimLost:
+			select {
+			case lostCh <- selection:
+			case <-doneCh:
+			}
+			return
+		}
+		logger.Printf("Error verifying claim of role %s, slot %d: %v", selection.Entry.RoleName, selection.Slot, err)
+		select {
+		case <-time.After(watchErrorDelay):
+		case <-doneCh:
+			return
+		}
+	}
+}
+
+// runCommand selects roles and runs a command with them, holding the
+// claimed slots for as long as the command runs. Signals are forwarded
+// to the command, and the slots are released when it exits.
+func runCommand(args []string, logger *log.Logger) {
+	var opts selectOptions
+	var watch bool
+	var reloadSignalName, reloadCommand, roleFile string
+	var rebalanceInterval, rebalanceJitter time.Duration
+	var verifyInterval time.Duration
+	var onLost, lostCommand string
+	flags := newSelectFlagSet("run", &opts)
+	flags.BoolVar(&watch, "watch", false, "watch the configuration at -consul-path and select again when it changes")
+	flags.StringVar(&reloadSignalName, "reload-signal", "", "the signal sent to the command when its roles change, e.g. HUP")
+	flags.StringVar(&reloadCommand, "reload-command", "", "a shell command run with the new role environment when the roles change")
+	flags.StringVar(&roleFile, "role-file", "", "a file that is kept up to date with the role definitions, one per line")
+	flags.DurationVar(&rebalanceInterval, "rebalance-interval", 0, "how often a randomly chosen role tries to move into a freed slot (0 disables it)")
+	flags.DurationVar(&rebalanceJitter, "rebalance-jitter", 0, "a random delay of up to this duration added to each -rebalance-interval")
+	flags.DurationVar(&verifyInterval, "verify-interval", 0, "how often the claims are verified while the command runs (0 disables it)")
+	flags.StringVar(&onLost, "on-lost", onLostKill, "what to do when a claim is lost: kill, hook or reclaim")
+	flags.StringVar(&lostCommand, "lost-command", "", "a shell command run with the lost role's environment when -on-lost is hook")
+	flags.Parse(args)
+
+	clierr := func(msg string, params ...interface{}) {
+		fmt.Fprintf(os.Stderr, msg+"\n", params...)
+		os.Exit(1)
+	}
+
+	command := flags.Args()
+	if len(command) == 0 {
+		clierr("usage: talcum run [flags] -- command [args...]")
+	}
+	if watch && opts.selectorConfigConsulPath == "" {
+		clierr("-watch requires -consul-path")
+	}
+	switch onLost {
+	case onLostKill, onLostReclaim:
+	case onLostHook:
+		if lostCommand == "" {
+			clierr("-on-lost hook requires -lost-command")
+		}
+	default:
+		clierr("unknown -on-lost reaction: %s", onLost)
+	}
+	var reloadSignal syscall.Signal
+	if reloadSignalName != "" {
+		var err error
+		reloadSignal, err = parseSignal(reloadSignalName)
+		if err != nil {
+			clierr("%v", err)
+		}
+	}
+
+	// Signals are caught before selecting so that a slot claimed
+	// in the meantime is still released. SIGTERM and SIGINT cancel
+	// the selection, e.g. while waiting for a slot with -overflow
+	// block, and other signals received before the command starts
+	// are forwarded once it has started.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+
+	type selected struct {
+		selector   *talcum.Selector
+		locker     talcum.Locker
+		selections []*talcum.Selection
+	}
+	selectedCh := make(chan selected, 1)
+	cancelCh := make(chan struct{})
+	go func() {
+		selector, locker, selections := opts.selectRoles(logger, cancelCh)
+		selectedCh <- selected{selector, locker, selections}
+	}()
+
+	var canceledBy syscall.Signal
+	var pending []os.Signal
+	var result selected
+	for waiting := true; waiting; {
+		select {
+		case result = <-selectedCh:
+			waiting = false
+		case sig := <-signals:
+			if canceledBy == 0 && (sig == syscall.SIGTERM || sig == syscall.SIGINT) {
+				logger.Printf("Received %v, canceling the selection", sig)
+				canceledBy = sig.(syscall.Signal)
+				close(cancelCh)
+				continue
+			}
+			pending = append(pending, sig)
+		}
+	}
+	selector, locker, selections := result.selector, result.locker, result.selections
+
+	release := func() {
+		if locker == nil {
+			return
+		}
+		for _, selection := range selections {
+			err := selector.ReleaseClaim(selection)
+			if err == talcum.ErrClaimLost {
+				logger.Printf("Role %s, slot %d was claimed by another actor, leaving it", selection.Entry.RoleName, selection.Slot)
+			} else if err != nil {
+				logger.Printf("Error releasing role %s, slot %d: %v", selection.Entry.RoleName, selection.Slot, err)
+			}
+		}
+	}
+
+	// Locks that expire are kept alive until the slots are
+	// released. Renew is started again after it fails, after a
+	// third of the TTL like a renewal, so that the slots claimed in
+	// place of lost ones are kept alive too. Lockers that renew
+	// their locks one by one report the ones they lose and keep
+	// renewing the others.
+	_, ttl := opts.expiry()
+	renewRetryDelay := ttl / 3
+	if renewRetryDelay <= 0 {
+		renewRetryDelay = time.Second
+	}
+	lockLostCh := make(chan string)
+	if notifier, ok := locker.(talcum.LossNotifier); ok {
+		notifier.NotifyLost(lockLostCh)
+	}
+	doneCh := make(chan struct{})
+	var renewErrCh chan error
+	startRenew := func(delay time.Duration) {
+		renewer, ok := locker.(talcum.Renewer)
+		if !ok {
+			return
+		}
+		errCh := make(chan error, 1)
+		renewErrCh = errCh
+		go func() {
+			select {
+			case <-time.After(delay):
+			case <-doneCh:
+				errCh <- nil
+				return
+			}
+			errCh <- renewer.Renew(doneCh)
+		}()
+	}
+	startRenew(0)
+	stop := func() {
+		release()
+		close(doneCh)
+		if renewErrCh != nil {
+			if err := <-renewErrCh; err != nil {
+				logger.Printf("Error releasing locks: %v", err)
+			}
+		}
+	}
+
+	if canceledBy != 0 {
+		stop()
+		os.Exit(128 + int(canceledBy))
+	}
+
+	if roleFile != "" {
+		if err := writeRoleFile(roleFile, selections); err != nil {
+			stop()
+			clierr("error writing role file: %v", err)
+		}
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), roleEnv(&opts.config, selections)...)
+	if err := cmd.Start(); err != nil {
+		stop()
+		clierr("error starting command: %v", err)
+	}
+
+	for _, sig := range pending {
+		logger.Printf("Received %v, forwarding it to command", sig)
+		cmd.Process.Signal(sig)
+	}
+
+	exitCh := make(chan error, 1)
+	go func() {
+		exitCh <- cmd.Wait()
+	}()
+
+	// notify tells the command that its roles changed.
+	notify := func() {
+		if roleFile != "" {
+			if err := writeRoleFile(roleFile, selections); err != nil {
+				logger.Printf("Error writing role file: %v", err)
+			}
+		}
+		if reloadSignal != 0 {
+			cmd.Process.Signal(reloadSignal)
+		}
+		if reloadCommand != "" {
+			if err := runHook(reloadCommand, &opts.config, selections); err != nil {
+				logger.Printf("Error running reload command: %v", err)
+			}
+		}
+	}
+
+	var configCh chan talcum.SelectorConfig
+	if watch {
+		consulClient, err := opts.consul()
+		if err != nil {
+			stop()
+			clierr("%v", err)
+		}
+		configCh = make(chan talcum.SelectorConfig)
+		go watchConfig(consulClient.KV(), opts.selectorConfigConsulPath, configCh, logger)
+	}
+
+	// Randomly chosen roles periodically try to move into freed
+	// slots. Each attempt moves at most one role, and the jitter
+	// keeps actors that started together from moving together.
+	var rebalanceCh <-chan time.Time
+	scheduleRebalance := func() {
+		if rebalanceInterval <= 0 {
+			return
+		}
+		wait := rebalanceInterval
+		if rebalanceJitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(rebalanceJitter)))
+		}
+		rebalanceCh = time.After(wait)
+	}
+	scheduleRebalance()
+
+	// The claims are watched until the command exits or the
+	// selections change, which restarts the watches. Losses
+	// reported for selections that are no longer held are
+	// ignored.
+	lostCh := make(chan *talcum.Selection)
+	var watchDoneCh chan struct{}
+	restartWatches := func() {
+		if verifyInterval <= 0 || locker == nil {
+			return
+		}
+		if watchDoneCh != nil {
+			close(watchDoneCh)
+		}
+		watchDoneCh = make(chan struct{})
+		for _, selection := range selections {
+			go watchClaim(selector, selection, verifyInterval, lostCh, watchDoneCh, logger)
+		}
+	}
+	restartWatches()
+
+	// handleLost reacts to the loss of claims as configured by
+	// -on-lost. The lost slots may be held by other actors now, so
+	// they are dropped without being released.
+	handleLost := func(lost []*talcum.Selection) {
+		lost = without(lost, without(lost, selections))
+		if len(lost) == 0 {
+			return
+		}
+		for _, selection := range lost {
+			logger.Printf("Lost claim of role %s, slot %d", selection.Entry.RoleName, selection.Slot)
+		}
+		switch onLost {
+		case onLostKill:
+			selections = without(selections, lost)
+			cmd.Process.Signal(syscall.SIGTERM)
+		case onLostHook:
+			selections = without(selections, lost)
+			if err := runHook(lostCommand, &opts.config, lost); err != nil {
+				logger.Printf("Error running lost command: %v", err)
+			}
+			notify()
+		case onLostReclaim:
+			replaced, err := selector.Replace(selections, lost...)
+			if err != nil {
+				logger.Printf("Error claiming other slots: %v", err)
+			}
+			selections = replaced
+			for _, selection := range selections {
+				logger.Printf("role: %v, slot: %v", selection.Entry.RoleName, selection.Slot)
+			}
+			notify()
+		}
+		restartWatches()
+	}
+
+	// verifyAll returns the selections whose claims can't be
+	// verified.
+	verifyAll := func() []*talcum.Selection {
+		var lost []*talcum.Selection
+		for _, selection := range selections {
+			if err := selector.Verify(selection); err != nil {
+				if err != talcum.ErrClaimLost {
+					logger.Printf("Error verifying claim of role %s, slot %d: %v", selection.Entry.RoleName, selection.Slot, err)
+				}
+				lost = append(lost, selection)
+			}
+		}
+		return lost
+	}
+
+	var err error
+	for exited := false; !exited; {
+		select {
+		case <-rebalanceCh:
+			rebalanced, moved, err := selector.Rebalance(selections, 1)
+			if err != nil {
+				logger.Printf("Error moving into a freed slot: %v", err)
+			}
+			selections = rebalanced
+			if moved {
+				for _, selection := range selections {
+					logger.Printf("role: %v, slot: %v", selection.Entry.RoleName, selection.Slot)
+				}
+				notify()
+				restartWatches()
+			}
+			scheduleRebalance()
+		case selectorConfig := <-configCh:
+			next := talcum.NewSelector(&opts.config, selectorConfig, locker)
+			var reselected []*talcum.Selection
+			var changed bool
+			var err error
+			if id := selectorConfig.SelectionID(opts.deployID); opts.selectionIDFromConfig && id != opts.config.SelectionID {
+				// The new config has its own selection ID, so
+				// the roles are selected from scratch. If they
+				// can't all be claimed again, the command is
+				// left running roles it holds no claim for,
+				// which are handled like lost claims.
+				release()
+				opts.config.SelectionID = id
+				reselected, err = next.SelectManySlots(len(selections))
+				if err != nil {
+					logger.Printf("Error selecting roles for the new config: %v", err)
+					for _, selection := range reselected {
+						if err := next.ReleaseClaim(selection); err != nil {
+							logger.Printf("Error releasing role %s, slot %d: %v", selection.Entry.RoleName, selection.Slot, err)
+						}
+					}
+					selector = next
+					handleLost(selections)
+					continue
+				}
+				changed = true
+			} else {
+				reselected, changed, err = next.Reselect(selections)
+			}
+			if err != nil {
+				logger.Printf("Error selecting roles for the new config: %v", err)
+			}
+			selector, selections = next, reselected
+			if changed {
+				for _, selection := range selections {
+					logger.Printf("role: %v, slot: %v", selection.Entry.RoleName, selection.Slot)
+				}
+				notify()
+				restartWatches()
+			}
+		case lost := <-lostCh:
+			handleLost([]*talcum.Selection{lost})
+		case sig := <-signals:
+			logger.Printf("Received %v, forwarding it to command", sig)
+			cmd.Process.Signal(sig)
+		case renewErr := <-renewErrCh:
+			renewErrCh = nil
+			if renewErr == nil {
+				continue
+			}
+			// The locks were not kept alive, so the claims that
+			// can't be verified anymore are treated as lost.
+			logger.Printf("Error keeping locks alive: %v", renewErr)
+			startRenew(renewRetryDelay)
+			handleLost(verifyAll())
+		case key := <-lockLostCh:
+			logger.Printf("Lock %s could not be kept alive", key)
+			handleLost(verifyAll())
+		case err = <-exitCh:
+			exited = true
+		}
+	}
+
+	if err != nil {
+		logger.Printf("Command exited: %v", err)
+	}
+	if watchDoneCh != nil {
+		close(watchDoneCh)
+	}
+	stop()
+	os.Exit(exitCode(err))
+}
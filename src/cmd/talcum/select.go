@@ -0,0 +1,233 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dollarshaveclub/talcum/src/talcum"
+)
+
+// exitAllSlotsTaken is the exit code of select when every slot is
+// taken and the overflow policy does not select a role anyway.
+const exitAllSlotsTaken = 3
+
+// labels is a flag that can be repeated to set key=value labels.
+type labels map[string]string
+
+func (l labels) String() string {
+	var pairs []string
+	for key, value := range l {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l labels) Set(pair string) error {
+	parts := strings.SplitN(pair, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("label must be key=value: %s", pair)
+	}
+	l[parts[0]] = parts[1]
+	return nil
+}
+
+// selectOptions contains the flags of the commands that select roles.
+type selectOptions struct {
+	options
+	mconfig     talcum.MetricsConfig
+	members     string
+	membersPath string
+	maxRoles    int
+	overflow    string
+}
+
+func newSelectFlagSet(name string, opts *selectOptions) *flag.FlagSet {
+	flags := newFlagSet(name, &opts.options)
+	flags.DurationVar(&opts.config.LockDelay, "lock-delay", 0, "the delay in between lock attempts")
+	flags.BoolVar(&opts.config.Prioritize, "prioritize", false, "fill the slots of roles with a higher priority first")
+	flags.BoolVar(&opts.config.Sticky, "sticky", false, "re-adopt the slot held by -actor-id before selecting a new one")
+	opts.config.Labels = make(labels)
+	flags.Var(labels(opts.config.Labels), "label", "a key=value label of the actor, roles that require other labels are never selected (repeatable)")
+	flags.StringVar(&opts.config.Zone, "zone", "", "the availability zone of the actor, used to spread roles that set zones")
+	flags.StringVar(&opts.members, "members", "", "comma-separated IDs of every actor, assigns slots by rendezvous hashing without locks")
+	flags.StringVar(&opts.membersPath, "members-file", "", "a file listing the ID of every actor, one per line, instead of -members")
+	flags.IntVar(&opts.maxRoles, "max-roles", 1, "the number of slots to claim, one role definition is printed per line")
+	flags.BoolVar(&opts.config.DistinctRoles, "distinct-roles", false, "claim the slots of distinct roles only with -max-roles")
+	flags.StringVar(&opts.overflow, "overflow", "random", "what to do when every slot is taken: random, fail, block, least-recent or spare")
+	flags.DurationVar(&opts.config.OverflowTimeout, "overflow-timeout", 0, "how long -overflow block waits for a free slot (0 waits forever)")
+	flags.StringVar(&opts.mconfig.StatsdAddr, "statsd-addr", "0.0.0.0:8125", "statsd (dogstatsd) address")
+	flags.BoolVar(&opts.mconfig.Datadog, "datadog", true, "statsd is Datadog (dogstatsd)")
+	flags.StringVar(&opts.mconfig.Namespace, "metrics-namespace", "talcum", "Datadog metrics namespace (ignored if not using Datadog)")
+	flags.StringVar(&opts.mconfig.TagStr, "metrics-tags", "production", "Metrics tags (comma-delimited, either datadog <key>:<value> or influxdb <key>=<value>")
+	return flags
+}
+
+// readMembers reads actor IDs from a file, one per line. Empty lines
+// and lines starting with "#" are ignored.
+func readMembers(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading members: %v", err)
+	}
+	var members []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		members = append(members, line)
+	}
+	return members, nil
+}
+
+// checkOneShot exits if the flags make the locks of the backend
+// expire unless they are renewed, since only talcum run renews them
+// and the slot would be freed while the actor still uses its role.
+func (opts *selectOptions) checkOneShot(command string) {
+	if name, _ := opts.expiry(); name != "" {
+		fmt.Fprintf(os.Stderr, "%s can't be used with talcum %s, use talcum run to renew the locks\n", name, command)
+		os.Exit(1)
+	}
+}
+
+// selectRoles selects roles as configured by the flags, exiting if no
+// role can be selected. The locker is nil if slots are assigned to
+// members without locks. Closing cancelCh cancels the selection, in
+// which case the slots locked so far are returned so that they can be
+// released.
+func (opts *selectOptions) selectRoles(logger *log.Logger, cancelCh chan struct{}) (*talcum.Selector, talcum.Locker, []*talcum.Selection) {
+	if opts.mconfig.TagStr != "" {
+		opts.mconfig.Tags = strings.Split(opts.mconfig.TagStr, ",")
+	}
+
+	mc, err := talcum.NewStatsdCollector(&opts.mconfig, logger)
+	if err != nil {
+		logger.Printf("error initializing datadog collector: %v", err)
+	}
+
+	exit := func(code int, msg string, params ...interface{}) {
+		mc.RoleError()
+		mc.Flush()
+		fmt.Fprintf(os.Stderr, msg+"\n", params...)
+		os.Exit(code)
+	}
+	clierr := func(msg string, params ...interface{}) {
+		exit(1, msg, params...)
+	}
+
+	defer mc.Flush()
+	defer mc.TimeToPickRole(time.Now().UTC())
+
+	if opts.config.Sticky && opts.config.ActorID == "" {
+		clierr("-sticky requires -actor-id")
+	}
+	opts.config.Overflow, err = talcum.ParseOverflowPolicy(opts.overflow)
+	if err != nil {
+		clierr("%v", err)
+	}
+
+	if opts.members != "" {
+		opts.config.Members = strings.Split(opts.members, ",")
+	}
+	if opts.membersPath != "" {
+		opts.config.Members, err = readMembers(opts.membersPath)
+		if err != nil {
+			clierr("%v", err)
+		}
+	}
+
+	// The config is read first since it may determine the
+	// selection ID the locker is set up with.
+	selectorConfig, err := opts.selectorConfig()
+	if err != nil {
+		clierr("%v", err)
+	}
+
+	var locker talcum.Locker
+	if len(opts.config.Members) > 0 {
+		if opts.config.ActorID == "" {
+			clierr("-members requires -actor-id")
+		}
+	} else {
+		locker, err = opts.locker()
+		if err != nil {
+			clierr("%v", err)
+		}
+	}
+
+	if opts.maxRoles < 1 {
+		clierr("-max-roles must be at least 1")
+	}
+
+	selector := talcum.NewSelector(&opts.config, selectorConfig, locker)
+	if cancelCh != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-cancelCh:
+				selector.Cancel()
+			case <-finished:
+			}
+		}()
+	}
+	selections, err := selector.SelectManySlots(opts.maxRoles)
+	if err == talcum.ErrCanceled {
+		return selector, locker, selections
+	}
+	if err == talcum.ErrAllSlotsTaken {
+		exit(exitAllSlotsTaken, "%v", err)
+	}
+	if err == talcum.ErrNotEligible {
+		clierr("%v", err)
+	}
+	if err != nil {
+		logger.Printf("Error selecting an entry: %s", err)
+		if len(selections) == 0 {
+			logger.Printf("Selecting random entry")
+			entry := selectRandom(selectorConfig, &opts.config)
+			if entry == nil {
+				clierr("no role can be selected randomly")
+			}
+			selections = []*talcum.Selection{{
+				Entry: entry,
+				Slot:  -1,
+			}}
+			mc.RandomRoleChosen()
+		}
+	}
+
+	for _, selection := range selections {
+		entry := selection.Entry
+		mc.RoleChosen(entry.RoleName)
+		logger.Printf("role: %v", entry.RoleName)
+		if !selection.Random() {
+			logger.Printf("slot: %v", selection.Slot)
+		}
+	}
+	return selector, locker, selections
+}
+
+// selectCommand selects roles and prints their definitions.
+func selectCommand(args []string, logger *log.Logger) {
+	var opts selectOptions
+	flags := newSelectFlagSet("select", &opts)
+	flags.Parse(args)
+	opts.checkOneShot("select")
+
+	if opts.backend == "zookeeper" && opts.members == "" && opts.membersPath == "" {
+		logger.Printf("warning: zookeeper locks are ephemeral and are released when talcum exits, use talcum run to hold them")
+	}
+
+	_, _, selections := opts.selectRoles(logger, nil)
+	for _, selection := range selections {
+		fmt.Println(selection.Entry.RoleDefinition)
+	}
+}
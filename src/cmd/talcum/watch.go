@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dollarshaveclub/talcum/src/talcum"
+)
+
+// watchErrorDelay is how long watchConfig waits after an error.
+const watchErrorDelay = 5 * time.Second
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// parseSignal parses a signal name such as "HUP" or "SIGHUP".
+func parseSignal(name string) (syscall.Signal, error) {
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal: %s", name)
+	}
+	return sig, nil
+}
+
+// watchConfig sends every valid change of the role configuration at
+// path to configCh. Errors, including invalid configurations, are
+// logged and the watch continues.
+func watchConfig(kv talcum.ConsulKVClient, path string, configCh chan<- talcum.SelectorConfig, logger *log.Logger) {
+	watcher := talcum.NewConsulConfigWatcher(kv, path)
+	for {
+		selectorConfig, err := watcher.Next()
+		if err != nil {
+			logger.Printf("Error watching config, keeping the current one: %v", err)
+			time.Sleep(watchErrorDelay)
+			continue
+		}
+		configCh <- selectorConfig
+	}
+}
+
+// writeRoleFile atomically replaces the file at path with the role
+// definitions of selections, one per line.
+func writeRoleFile(path string, selections []*talcum.Selection) error {
+	var b strings.Builder
+	for _, selection := range selections {
+		b.WriteString(selection.Entry.RoleDefinition + "\n")
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".talcum-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// runHook runs a shell command with the role environment of
+// selections.
+func runHook(command string, config *talcum.Config, selections []*talcum.Selection) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), roleEnv(config, selections)...)
+	return cmd.Run()
+}
@@ -0,0 +1,101 @@
+package talcum
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Version is the version of talcum recorded in claims. It is set at
+// build time.
+var Version = "dev"
+
+// Claim records who holds a slot. It is stored as JSON in the value
+// of the slot's lock.
+type Claim struct {
+	ActorID    string    `json:"actor_id"`
+	Hostname   string    `json:"hostname"`
+	PID        int       `json:"pid"`
+	RoleName   string    `json:"role_name"`
+	Slot       int       `json:"slot"`
+	ClaimedAt  time.Time `json:"claimed_at"`
+	Version    string    `json:"version"`
+	ConfigHash string    `json:"config_hash"`
+	Zone       string    `json:"zone,omitempty"`
+}
+
+// ParseClaim parses the value of a lock. Locks set by older versions
+// of talcum do not contain a claim and return an error.
+func ParseClaim(value []byte) (*Claim, error) {
+	var claim Claim
+	if err := json.Unmarshal(value, &claim); err != nil {
+		return nil, fmt.Errorf("error unmarshaling claim: %v", err)
+	}
+	return &claim, nil
+}
+
+// Hash returns a hex-encoded SHA-256 hash of the configuration. The
+// entries are hashed in the order of their role names, so reordering
+// the roles doesn't change the hash.
+func (s SelectorConfig) Hash() string {
+	sorted := make(SelectorConfig, len(s))
+	copy(sorted, s)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].RoleName < sorted[j].RoleName
+	})
+	b, err := json.Marshal(sorted)
+	if err != nil {
+		// A SelectorConfig only contains strings, ints, bools
+		// and maps of strings, so this can't happen.
+		panic(err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// selectionIDHashLength is the number of hex digits of the
+// configuration hash used in a derived selection ID.
+const selectionIDHashLength = 12
+
+// SelectionID returns a selection ID derived from the hash of the
+// configuration, so that a changed configuration starts a fresh
+// selection instead of being blocked by the locks of the old one. A
+// deploy ID, if any, is prepended to it.
+func (s SelectorConfig) SelectionID(deployID string) string {
+	id := s.Hash()[:selectionIDHashLength]
+	if deployID != "" {
+		id = deployID + "-" + id
+	}
+	return id
+}
+
+// DefaultActorID returns an ID for the current process made of its
+// hostname and PID.
+func DefaultActorID() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+func (s *Selector) actorID() string {
+	if s.talcumConfig.ActorID == "" {
+		return DefaultActorID()
+	}
+	return s.talcumConfig.ActorID
+}
+
+func (s *Selector) newClaim(entry *SelectorEntry, slot int) *Claim {
+	hostname, _ := os.Hostname()
+	return &Claim{
+		ActorID:    s.actorID(),
+		Hostname:   hostname,
+		PID:        os.Getpid(),
+		RoleName:   entry.RoleName,
+		Slot:       slot,
+		ClaimedAt:  time.Now().UTC(),
+		Version:    Version,
+		ConfigHash: s.selectorConfig.Hash(),
+		Zone:       s.talcumConfig.Zone,
+	}
+}
@@ -0,0 +1,68 @@
+package talcum
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// ConsulConfigWatcher watches a configuration stored in a Consul key
+// using blocking queries.
+type ConsulConfigWatcher struct {
+	kvClient ConsulKVClient
+	path     string
+	index    uint64
+	value    []byte
+}
+
+// NewConsulConfigWatcher creates a new ConsulConfigWatcher.
+func NewConsulConfigWatcher(kv ConsulKVClient, path string) *ConsulConfigWatcher {
+	return &ConsulConfigWatcher{
+		kvClient: kv,
+		path:     path,
+	}
+}
+
+// Next blocks until the configuration changes and returns it after
+// validating it. The first call returns the current configuration.
+// A configuration that fails to parse or validate is returned as an
+// error once, and Next can be called again to wait for the next
+// change.
+func (w *ConsulConfigWatcher) Next() (SelectorConfig, error) {
+	for {
+		kvPair, meta, err := w.kvClient.Get(w.path, &api.QueryOptions{WaitIndex: w.index})
+		if err != nil {
+			return nil, fmt.Errorf("error watching config: %v", err)
+		}
+		if meta != nil {
+			// Consul resets the index if it goes backwards, e.g.
+			// after a snapshot restore.
+			if meta.LastIndex < w.index {
+				w.index = 0
+			} else {
+				w.index = meta.LastIndex
+			}
+		}
+		if kvPair == nil {
+			return nil, fmt.Errorf("config not found: %s", w.path)
+		}
+
+		// Blocking queries can return without the key having
+		// changed.
+		if w.value != nil && bytes.Equal(kvPair.Value, w.value) {
+			continue
+		}
+		w.value = kvPair.Value
+
+		var selectorConfig SelectorConfig
+		if err := json.Unmarshal(kvPair.Value, &selectorConfig); err != nil {
+			return nil, fmt.Errorf("error unmarshaling config: %v", err)
+		}
+		if err := selectorConfig.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid config: %v", err)
+		}
+		return selectorConfig, nil
+	}
+}
@@ -1,16 +1,59 @@
 package talcum
 
-import "github.com/hashicorp/consul/api"
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+)
 
 // ConsulKVClient is the interface to a Consul KV store with a
 // check-and-set operation.
 type ConsulKVClient interface {
+	Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error)
+	Keys(prefix, separator string, q *api.QueryOptions) ([]string, *api.QueryMeta, error)
 	CAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error)
+	Acquire(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error)
+	Delete(key string, w *api.WriteOptions) (*api.WriteMeta, error)
+	DeleteCAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error)
+}
+
+// ConsulSessionClient is the interface to the Consul session
+// endpoints.
+type ConsulSessionClient interface {
+	Create(se *api.SessionEntry, q *api.WriteOptions) (string, *api.WriteMeta, error)
+	CreateNoChecks(se *api.SessionEntry, q *api.WriteOptions) (string, *api.WriteMeta, error)
+	RenewPeriodic(initialTTL string, id string, q *api.WriteOptions, doneCh chan struct{}) error
+	Destroy(id string, q *api.WriteOptions) (*api.WriteMeta, error)
+	Info(id string, q *api.QueryOptions) (*api.SessionEntry, *api.QueryMeta, error)
+}
+
+// ConsulSessionConfig contains the options used when creating the
+// Consul session that locks are attached to.
+type ConsulSessionConfig struct {
+	// Name is the human readable name of the session.
+	Name string
+	// TTL is the session TTL. A session with a TTL must be renewed
+	// with RenewSession or its locks are deleted once it expires.
+	TTL time.Duration
+	// Checks are the health checks the session is tied to. Consul
+	// uses "serfHealth" for the node health check. If empty, the
+	// session has no health checks and should be given a TTL.
+	Checks []string
+	// LockDelay is how long Consul prevents a lock from being
+	// acquired again after the session is invalidated.
+	LockDelay time.Duration
 }
 
 // ConsulLocker can lock keys using Consul as a backend.
 type ConsulLocker struct {
-	kvClient ConsulKVClient
+	kvClient      ConsulKVClient
+	sessionClient ConsulSessionClient
+	sessionConfig *ConsulSessionConfig
+
+	mu        sync.Mutex
+	sessionID string
 }
 
 // NewConsulLocker creates a new ConsulLocker.
@@ -18,15 +61,232 @@ func NewConsulLocker(kv ConsulKVClient) *ConsulLocker {
 	return &ConsulLocker{kvClient: kv}
 }
 
-// Lock tries to lock a key, return true if the lock operation was
-// successful.
-func (c *ConsulLocker) Lock(key string) (bool, error) {
+// NewConsulSessionLocker creates a new ConsulLocker that acquires
+// locks with a Consul session. The session uses the "delete"
+// behavior, so locks are removed when the session is invalidated,
+// e.g. when the node holding it fails its health checks or its TTL
+// expires.
+func NewConsulSessionLocker(kv ConsulKVClient, session ConsulSessionClient, config *ConsulSessionConfig) *ConsulLocker {
+	return &ConsulLocker{
+		kvClient:      kv,
+		sessionClient: session,
+		sessionConfig: config,
+	}
+}
+
+// Lock tries to lock a key, storing value in it, return true if the
+// lock operation was successful.
+func (c *ConsulLocker) Lock(key string, value []byte) (bool, error) {
+	if c.sessionClient != nil {
+		return c.acquire(key, value)
+	}
+
 	set, _, err := c.kvClient.CAS(&api.KVPair{
 		Key:   key,
-		Value: []byte("1"),
+		Value: value,
 	}, nil)
 	if err != nil {
 		return false, err
 	}
 	return set, nil
 }
+
+func (c *ConsulLocker) acquire(key string, value []byte) (bool, error) {
+	sessionID, err := c.session()
+	if err != nil {
+		return false, err
+	}
+
+	set, _, err := c.kvClient.Acquire(&api.KVPair{
+		Key:     key,
+		Value:   value,
+		Session: sessionID,
+	}, nil)
+	if err == nil {
+		return set, nil
+	}
+
+	// Consul rejects locks held by a session that was invalidated,
+	// e.g. because its node failed its health checks, in which case
+	// the lock is acquired again with a new session.
+	entry, _, infoErr := c.sessionClient.Info(sessionID, nil)
+	if infoErr != nil || entry != nil {
+		return false, err
+	}
+	c.resetSession(sessionID)
+	if sessionID, err = c.session(); err != nil {
+		return false, err
+	}
+	set, _, err = c.kvClient.Acquire(&api.KVPair{
+		Key:     key,
+		Value:   value,
+		Session: sessionID,
+	}, nil)
+	if err != nil {
+		return false, err
+	}
+	return set, nil
+}
+
+// Get returns the value of a key or nil if it is not locked.
+func (c *ConsulLocker) Get(key string) ([]byte, error) {
+	kvPair, _, err := c.kvClient.Get(key, nil)
+	if err != nil || kvPair == nil {
+		return nil, err
+	}
+	return kvPair.Value, nil
+}
+
+// Keys returns every locked key under a prefix.
+func (c *ConsulLocker) Keys(prefix string) ([]string, error) {
+	keys, _, err := c.kvClient.Keys(prefix, "", nil)
+	return keys, err
+}
+
+// consulWatchWaitTime bounds the blocking queries made by Watch.
+const consulWatchWaitTime = 5 * time.Minute
+
+// Watch blocks until the value of key is no longer value, using
+// blocking queries, or until doneCh is closed.
+func (c *ConsulLocker) Watch(key string, value []byte, doneCh chan struct{}) (bool, error) {
+	type result struct {
+		kvPair *api.KVPair
+		meta   *api.QueryMeta
+		err    error
+	}
+
+	var index uint64
+	for {
+		resultCh := make(chan result, 1)
+		go func(index uint64) {
+			kvPair, meta, err := c.kvClient.Get(key, &api.QueryOptions{
+				WaitIndex: index,
+				WaitTime:  consulWatchWaitTime,
+			})
+			resultCh <- result{kvPair, meta, err}
+		}(index)
+
+		select {
+		case <-doneCh:
+			return true, nil
+		case r := <-resultCh:
+			if r.err != nil {
+				return true, r.err
+			}
+			if r.kvPair == nil || !bytes.Equal(r.kvPair.Value, value) {
+				return false, nil
+			}
+			if r.meta != nil {
+				index = r.meta.LastIndex
+			}
+		}
+	}
+}
+
+// Unlock releases a key by deleting it, regardless of which session
+// holds it.
+func (c *ConsulLocker) Unlock(key string) error {
+	_, err := c.kvClient.Delete(key, nil)
+	return err
+}
+
+// UnlockIf implements CompareUnlocker by deleting the key with a
+// check-and-set on the index it was read at.
+func (c *ConsulLocker) UnlockIf(key string, held func(value []byte) bool) (bool, error) {
+	kvPair, _, err := c.kvClient.Get(key, nil)
+	if err != nil {
+		return false, err
+	}
+	if kvPair == nil || !held(kvPair.Value) {
+		return false, nil
+	}
+	deleted, _, err := c.kvClient.DeleteCAS(kvPair, nil)
+	if err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
+
+// session returns the ID of the locker's session, creating the
+// session if necessary.
+func (c *ConsulLocker) session() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.sessionID != "" {
+		return c.sessionID, nil
+	}
+
+	entry := &api.SessionEntry{
+		Name:      c.sessionConfig.Name,
+		Checks:    c.sessionConfig.Checks,
+		LockDelay: c.sessionConfig.LockDelay,
+		Behavior:  api.SessionBehaviorDelete,
+	}
+	if c.sessionConfig.TTL > 0 {
+		entry.TTL = c.sessionConfig.TTL.String()
+	}
+
+	var id string
+	var err error
+	if len(entry.Checks) == 0 {
+		id, _, err = c.sessionClient.CreateNoChecks(entry, nil)
+	} else {
+		id, _, err = c.sessionClient.Create(entry, nil)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	c.sessionID = id
+	return id, nil
+}
+
+// resetSession forgets the locker's session if it is still id, so
+// that a new session is created for the next lock.
+func (c *ConsulLocker) resetSession(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessionID == id {
+		c.sessionID = ""
+	}
+}
+
+// Renew implements Renewer using RenewSession.
+func (c *ConsulLocker) Renew(doneCh chan struct{}) error {
+	return c.RenewSession(doneCh)
+}
+
+// RenewSession periodically renews the locker's session until doneCh
+// is closed, after which the session is destroyed. A session without
+// a TTL is only destroyed. It returns immediately if the locker does
+// not use a session. If the session could not be renewed, it has
+// expired, and a new session is created for later locks, so that
+// RenewSession can be called again to keep them alive.
+func (c *ConsulLocker) RenewSession(doneCh chan struct{}) error {
+	if c.sessionClient == nil {
+		return nil
+	}
+	if c.sessionConfig.TTL <= 0 {
+		<-doneCh
+		c.mu.Lock()
+		sessionID := c.sessionID
+		c.sessionID = ""
+		c.mu.Unlock()
+		if sessionID == "" {
+			return nil
+		}
+		_, err := c.sessionClient.Destroy(sessionID, nil)
+		return err
+	}
+
+	sessionID, err := c.session()
+	if err != nil {
+		return err
+	}
+	err = c.sessionClient.RenewPeriodic(c.sessionConfig.TTL.String(), sessionID, nil, doneCh)
+	if err != nil {
+		c.resetSession(sessionID)
+	}
+	return err
+}
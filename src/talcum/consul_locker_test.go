@@ -0,0 +1,389 @@
+package talcum_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/talcum/src/talcum"
+	"github.com/hashicorp/consul/api"
+)
+
+type mockConsulKV struct {
+	pairs    map[string]*api.KVPair
+	cas      int
+	index    uint64
+	sessions *mockConsulSession
+}
+
+func newMockConsulKV() *mockConsulKV {
+	return &mockConsulKV{
+		pairs: make(map[string]*api.KVPair),
+	}
+}
+
+func (m *mockConsulKV) Get(key string, q *api.QueryOptions) (*api.KVPair, *api.QueryMeta, error) {
+	return m.pairs[key], &api.QueryMeta{LastIndex: m.index}, nil
+}
+
+func (m *mockConsulKV) put(key string, value string) {
+	m.index++
+	m.pairs[key] = &api.KVPair{Key: key, Value: []byte(value), ModifyIndex: m.index}
+}
+
+func (m *mockConsulKV) Keys(prefix, separator string, q *api.QueryOptions) ([]string, *api.QueryMeta, error) {
+	var keys []string
+	for key := range m.pairs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil, nil
+}
+
+func (m *mockConsulKV) CAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	m.cas++
+	if _, ok := m.pairs[p.Key]; ok {
+		return false, nil, nil
+	}
+	m.index++
+	p.ModifyIndex = m.index
+	m.pairs[p.Key] = p
+	return true, nil, nil
+}
+
+func (m *mockConsulKV) Acquire(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	if m.sessions != nil && m.sessions.invalid[p.Session] {
+		return false, nil, errors.New("invalid session")
+	}
+	if existing, ok := m.pairs[p.Key]; ok && existing.Session != "" && existing.Session != p.Session {
+		return false, nil, nil
+	}
+	m.index++
+	p.ModifyIndex = m.index
+	m.pairs[p.Key] = p
+	return true, nil, nil
+}
+
+func (m *mockConsulKV) Delete(key string, w *api.WriteOptions) (*api.WriteMeta, error) {
+	delete(m.pairs, key)
+	return nil, nil
+}
+
+func (m *mockConsulKV) DeleteCAS(p *api.KVPair, q *api.WriteOptions) (bool, *api.WriteMeta, error) {
+	if existing, ok := m.pairs[p.Key]; !ok || existing.ModifyIndex != p.ModifyIndex {
+		return false, nil, nil
+	}
+	delete(m.pairs, p.Key)
+	return true, nil, nil
+}
+
+type mockConsulSession struct {
+	created   []*api.SessionEntry
+	destroyed []string
+	invalid   map[string]bool
+}
+
+func (m *mockConsulSession) Create(se *api.SessionEntry, q *api.WriteOptions) (string, *api.WriteMeta, error) {
+	m.created = append(m.created, se)
+	if len(m.created) > 1 {
+		return fmt.Sprintf("session-id-%d", len(m.created)), nil, nil
+	}
+	return "session-id", nil, nil
+}
+
+func (m *mockConsulSession) CreateNoChecks(se *api.SessionEntry, q *api.WriteOptions) (string, *api.WriteMeta, error) {
+	m.created = append(m.created, se)
+	return "session-id-no-checks", nil, nil
+}
+
+func (m *mockConsulSession) RenewPeriodic(initialTTL string, id string, q *api.WriteOptions, doneCh chan struct{}) error {
+	if m.invalid[id] {
+		return api.ErrSessionExpired
+	}
+	return nil
+}
+
+func (m *mockConsulSession) Info(id string, q *api.QueryOptions) (*api.SessionEntry, *api.QueryMeta, error) {
+	if m.invalid[id] {
+		return nil, nil, nil
+	}
+	return &api.SessionEntry{ID: id}, nil, nil
+}
+
+// invalidate invalidates a session, deleting the locks it holds.
+func (m *mockConsulSession) invalidate(kv *mockConsulKV, id string) {
+	if m.invalid == nil {
+		m.invalid = make(map[string]bool)
+	}
+	m.invalid[id] = true
+	for key, pair := range kv.pairs {
+		if pair.Session == id {
+			delete(kv.pairs, key)
+		}
+	}
+}
+
+func (m *mockConsulSession) Destroy(id string, q *api.WriteOptions) (*api.WriteMeta, error) {
+	m.destroyed = append(m.destroyed, id)
+	return nil, nil
+}
+
+func TestConsulSessionLocker(t *testing.T) {
+	kv := newMockConsulKV()
+	sessions := &mockConsulSession{}
+	locker := talcum.NewConsulSessionLocker(kv, sessions, &talcum.ConsulSessionConfig{
+		Name:   "test",
+		TTL:    15 * time.Second,
+		Checks: []string{"serfHealth"},
+	})
+
+	for _, key := range []string{"a", "b"} {
+		locked, err := locker.Lock(key, []byte("1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !locked {
+			t.Fatalf("expected key to be locked: %s", key)
+		}
+		if kv.pairs[key].Session != "session-id" {
+			t.Fatalf("expected key to be held by session: %s", key)
+		}
+	}
+
+	if len(sessions.created) != 1 {
+		t.Fatalf("expected one session, created: %d", len(sessions.created))
+	}
+	if se := sessions.created[0]; se.Behavior != api.SessionBehaviorDelete || se.TTL != "15s" {
+		t.Fatalf("unexpected session entry: %+v", se)
+	}
+
+	other := talcum.NewConsulSessionLocker(kv, &mockConsulSession{}, &talcum.ConsulSessionConfig{})
+	locked, err := other.Lock("a", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Fatal("expected key held by another session to stay locked")
+	}
+
+	if err := locker.Unlock("a"); err != nil {
+		t.Fatal(err)
+	}
+	locked, err = other.Lock("a", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected unlocked key to be lockable")
+	}
+}
+
+func TestConsulLockerSelectSkipsTakenSlots(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      50,
+		},
+	}
+	kv := newMockConsulKV()
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, talcum.NewConsulLocker(kv))
+
+	for i := 0; i < 50; i++ {
+		kv.cas = 0
+		selection, err := selector.SelectSlot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selection.Random() {
+			t.Fatalf("selection %d: expected a free slot to be locked", i)
+		}
+		if kv.cas != 1 {
+			t.Fatalf("selection %d: expected one CAS, got: %d", i, kv.cas)
+		}
+	}
+
+	kv.cas = 0
+	selection, err := selector.SelectSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !selection.Random() {
+		t.Fatalf("expected a random selection, got slot: %d", selection.Slot)
+	}
+	if kv.cas != 0 {
+		t.Fatalf("expected no CAS once every slot is taken, got: %d", kv.cas)
+	}
+}
+
+func TestConsulConfigWatcher(t *testing.T) {
+	kv := newMockConsulKV()
+	kv.put("config", `[{"role_name": "1", "num": 1}]`)
+	watcher := talcum.NewConsulConfigWatcher(kv, "config")
+
+	selectorConfig, err := watcher.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selectorConfig) != 1 || selectorConfig[0].Num != 1 {
+		t.Fatalf("unexpected config: %+v", selectorConfig)
+	}
+
+	kv.put("config", `[{"role_name": "1", "num": -1}]`)
+	if _, err := watcher.Next(); err == nil {
+		t.Fatal("expected an invalid config to be an error")
+	}
+
+	kv.put("config", `[{"role_name": "1", "num": 2}]`)
+	selectorConfig, err = watcher.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selectorConfig[0].Num != 2 {
+		t.Fatalf("expected the changed config, got num: %d", selectorConfig[0].Num)
+	}
+}
+
+func TestConsulLockerWatch(t *testing.T) {
+	kv := newMockConsulKV()
+	locker := talcum.NewConsulLocker(kv)
+	if _, err := locker.Lock("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	doneCh := make(chan struct{})
+	close(doneCh)
+	kv.put("a", "2")
+	held, err := locker.Watch("a", []byte("1"), make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held {
+		t.Fatal("expected a changed lock to be lost")
+	}
+
+	if err := locker.Unlock("a"); err != nil {
+		t.Fatal(err)
+	}
+	held, err = locker.Watch("a", []byte("2"), make(chan struct{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held {
+		t.Fatal("expected a deleted lock to be lost")
+	}
+}
+
+func TestConsulLockerUnlockIf(t *testing.T) {
+	kv := newMockConsulKV()
+	locker := talcum.NewConsulLocker(kv)
+	if _, err := locker.Lock("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	held := func(value []byte) bool { return string(value) == "1" }
+	kv.put("a", "2")
+	unlocked, err := locker.UnlockIf("a", held)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlocked || kv.pairs["a"] == nil {
+		t.Fatal("expected a lock with another value to stay locked")
+	}
+
+	kv.put("a", "1")
+	unlocked, err = locker.UnlockIf("a", held)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unlocked || kv.pairs["a"] != nil {
+		t.Fatal("expected the lock to be deleted")
+	}
+}
+
+func TestConsulLockerDestroysSessionWithoutTTL(t *testing.T) {
+	kv := newMockConsulKV()
+	sessions := &mockConsulSession{}
+	locker := talcum.NewConsulSessionLocker(kv, sessions, &talcum.ConsulSessionConfig{
+		Checks: []string{"serfHealth"},
+	})
+	if _, err := locker.Lock("a", []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	doneCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- locker.RenewSession(doneCh)
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("expected RenewSession to wait for doneCh, got: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(doneCh)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions.destroyed) != 1 || sessions.destroyed[0] != "session-id" {
+		t.Fatalf("expected the session to be destroyed, got: %v", sessions.destroyed)
+	}
+}
+
+func TestConsulSessionLockerReclaimsAfterSessionExpires(t *testing.T) {
+	for _, ttl := range []time.Duration{0, 15 * time.Second} {
+		kv := newMockConsulKV()
+		sessions := &mockConsulSession{}
+		kv.sessions = sessions
+		locker := talcum.NewConsulSessionLocker(kv, sessions, &talcum.ConsulSessionConfig{
+			TTL:    ttl,
+			Checks: []string{"serfHealth"},
+		})
+		selector := talcum.NewSelector(&talcum.Config{
+			ApplicationName: "test-app",
+			SelectionID:     "test-id",
+		}, talcum.SelectorConfig{
+			{
+				RoleName: "1",
+				Num:      2,
+			},
+		}, locker)
+
+		selection, err := selector.SelectSlot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions.invalidate(kv, "session-id")
+		if err := selector.Verify(selection); err != talcum.ErrClaimLost {
+			t.Fatalf("ttl %v: expected ErrClaimLost, got: %v", ttl, err)
+		}
+		if ttl > 0 {
+			if err := locker.RenewSession(make(chan struct{})); err != api.ErrSessionExpired {
+				t.Fatalf("expected ErrSessionExpired, got: %v", err)
+			}
+		}
+
+		selections, err := selector.Replace([]*talcum.Selection{selection}, selection)
+		if err != nil {
+			t.Fatalf("ttl %v: %v", ttl, err)
+		}
+		if len(selections) != 1 || selections[0].Random() {
+			t.Fatalf("ttl %v: expected a slot to be claimed again", ttl)
+		}
+		if err := selector.Verify(selections[0]); err != nil {
+			t.Fatalf("ttl %v: %v", ttl, err)
+		}
+		for key, pair := range kv.pairs {
+			if pair.Session != "session-id-2" {
+				t.Fatalf("ttl %v: expected %s to be held by a new session, got: %s", ttl, key, pair.Session)
+			}
+		}
+	}
+}
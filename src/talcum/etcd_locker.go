@@ -0,0 +1,335 @@
+package talcum
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EtcdClient is a client for the JSON gateway of the etcd v3 API.
+type EtcdClient struct {
+	endpoints  []string
+	httpClient *http.Client
+}
+
+// NewEtcdClient creates a new EtcdClient. Requests are sent to the
+// first endpoint that can be reached.
+func NewEtcdClient(endpoints []string, httpClient *http.Client) *EtcdClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &EtcdClient{
+		endpoints:  endpoints,
+		httpClient: httpClient,
+	}
+}
+
+// call posts req to the gateway at path and decodes the response
+// into resp.
+func (c *EtcdClient) call(path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, endpoint := range c.endpoints {
+		url := strings.TrimSuffix(endpoint, "/") + path
+		res, err := c.httpClient.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return decodeEtcdResponse(res, resp)
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no etcd endpoints configured")
+	}
+	return lastErr
+}
+
+// decodeEtcdResponse decodes the body of a gateway response into resp
+// and closes it.
+func decodeEtcdResponse(res *http.Response, resp interface{}) error {
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var buf bytes.Buffer
+		buf.ReadFrom(res.Body)
+		return fmt.Errorf("etcd error: %s: %s", res.Status, buf.String())
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// PutIfAbsent puts a key in a transaction that only succeeds if the
+// key has never been created. A lease ID of zero attaches no lease.
+func (c *EtcdClient) PutIfAbsent(key string, value []byte, leaseID int64) (bool, error) {
+	put := map[string]interface{}{
+		"key":   []byte(key),
+		"value": value,
+	}
+	if leaseID != 0 {
+		put["lease"] = strconv.FormatInt(leaseID, 10)
+	}
+	req := map[string]interface{}{
+		"compare": []map[string]interface{}{{
+			"key":             []byte(key),
+			"result":          "EQUAL",
+			"target":          "CREATE",
+			"create_revision": "0",
+		}},
+		"success": []map[string]interface{}{{
+			"request_put": put,
+		}},
+	}
+
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := c.call("/v3/kv/txn", req, &resp); err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// Get returns the value of a key or nil if it does not exist.
+func (c *EtcdClient) Get(key string) ([]byte, error) {
+	var resp struct {
+		KVs []struct {
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	err := c.call("/v3/kv/range", map[string]interface{}{
+		"key": []byte(key),
+	}, &resp)
+	if err != nil || len(resp.KVs) == 0 {
+		return nil, err
+	}
+	return resp.KVs[0].Value, nil
+}
+
+// Delete deletes a key.
+func (c *EtcdClient) Delete(key string) error {
+	return c.call("/v3/kv/deleterange", map[string]interface{}{
+		"key": []byte(key),
+	}, nil)
+}
+
+// DeleteIf deletes a key in a transaction that only succeeds if the
+// key still has value.
+func (c *EtcdClient) DeleteIf(key string, value []byte) (bool, error) {
+	req := map[string]interface{}{
+		"compare": []map[string]interface{}{{
+			"key":    []byte(key),
+			"result": "EQUAL",
+			"target": "VALUE",
+			"value":  value,
+		}},
+		"success": []map[string]interface{}{{
+			"request_delete_range": map[string]interface{}{
+				"key": []byte(key),
+			},
+		}},
+	}
+
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := c.call("/v3/kv/txn", req, &resp); err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// Grant creates a lease with a TTL, returning its ID.
+func (c *EtcdClient) Grant(ttl time.Duration) (int64, error) {
+	var resp struct {
+		ID string `json:"ID"`
+	}
+	err := c.call("/v3/lease/grant", map[string]interface{}{
+		"TTL": strconv.FormatInt(int64(ttl/time.Second), 10),
+	}, &resp)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(resp.ID, 10, 64)
+}
+
+// KeepAliveOnce renews a lease, returning false if the lease no
+// longer exists.
+func (c *EtcdClient) KeepAliveOnce(leaseID int64) (bool, error) {
+	var resp struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	err := c.call("/v3/lease/keepalive", map[string]interface{}{
+		"ID": strconv.FormatInt(leaseID, 10),
+	}, &resp)
+	if err != nil {
+		return false, err
+	}
+	ttl, _ := strconv.ParseInt(resp.Result.TTL, 10, 64)
+	return ttl > 0, nil
+}
+
+// Revoke revokes a lease, deleting all keys attached to it.
+func (c *EtcdClient) Revoke(leaseID int64) error {
+	return c.call("/v3/lease/revoke", map[string]interface{}{
+		"ID": strconv.FormatInt(leaseID, 10),
+	}, nil)
+}
+
+// EtcdKVClient is the interface to an etcd v3 KV store with
+// transactions and leases.
+type EtcdKVClient interface {
+	PutIfAbsent(key string, value []byte, leaseID int64) (bool, error)
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+	DeleteIf(key string, value []byte) (bool, error)
+	Grant(ttl time.Duration) (int64, error)
+	KeepAliveOnce(leaseID int64) (bool, error)
+	Revoke(leaseID int64) error
+}
+
+// EtcdLocker can lock keys using etcd v3 as a backend.
+type EtcdLocker struct {
+	client   EtcdKVClient
+	leaseTTL time.Duration
+
+	mu      sync.Mutex
+	leaseID int64
+}
+
+// NewEtcdLocker creates a new EtcdLocker. If leaseTTL is positive,
+// locks are attached to a lease and are deleted unless the lease is
+// renewed with RenewLease.
+func NewEtcdLocker(client EtcdKVClient, leaseTTL time.Duration) *EtcdLocker {
+	return &EtcdLocker{
+		client:   client,
+		leaseTTL: leaseTTL,
+	}
+}
+
+// Lock tries to lock a key, storing value in it, return true if the
+// lock operation was successful.
+func (e *EtcdLocker) Lock(key string, value []byte) (bool, error) {
+	leaseID, err := e.lease()
+	if err != nil {
+		return false, err
+	}
+	locked, err := e.client.PutIfAbsent(key, value, leaseID)
+	if err == nil || leaseID == 0 {
+		return locked, err
+	}
+
+	// etcd rejects keys attached to a lease that expired, in which
+	// case the key is put again with a new lease.
+	if alive, aliveErr := e.client.KeepAliveOnce(leaseID); aliveErr != nil || alive {
+		return false, err
+	}
+	e.resetLease(leaseID)
+	if leaseID, err = e.lease(); err != nil {
+		return false, err
+	}
+	return e.client.PutIfAbsent(key, value, leaseID)
+}
+
+// Get returns the value of a key or nil if it is not locked.
+func (e *EtcdLocker) Get(key string) ([]byte, error) {
+	return e.client.Get(key)
+}
+
+// Unlock releases a key by deleting it.
+func (e *EtcdLocker) Unlock(key string) error {
+	return e.client.Delete(key)
+}
+
+// UnlockIf implements CompareUnlocker by deleting the key in a
+// transaction that compares its value to the one that was read.
+func (e *EtcdLocker) UnlockIf(key string, held func(value []byte) bool) (bool, error) {
+	value, err := e.client.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if value == nil || !held(value) {
+		return false, nil
+	}
+	return e.client.DeleteIf(key, value)
+}
+
+// lease returns the ID of the locker's lease, granting the lease if
+// necessary. It returns zero if the locker does not use a lease.
+func (e *EtcdLocker) lease() (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.leaseTTL <= 0 || e.leaseID != 0 {
+		return e.leaseID, nil
+	}
+
+	id, err := e.client.Grant(e.leaseTTL)
+	if err != nil {
+		return 0, err
+	}
+	e.leaseID = id
+	return id, nil
+}
+
+// resetLease forgets the locker's lease if it is still id, so that a
+// new lease is granted for the next lock.
+func (e *EtcdLocker) resetLease(id int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leaseID == id {
+		e.leaseID = 0
+	}
+}
+
+// Renew implements Renewer using RenewLease.
+func (e *EtcdLocker) Renew(doneCh chan struct{}) error {
+	return e.RenewLease(doneCh)
+}
+
+// RenewLease periodically renews the locker's lease until doneCh is
+// closed, after which the lease is revoked. It returns immediately if
+// the locker does not use a lease. If the lease could not be renewed,
+// it has expired, and a new lease is granted for later locks, so that
+// RenewLease can be called again to keep them alive.
+func (e *EtcdLocker) RenewLease(doneCh chan struct{}) error {
+	if e.leaseTTL <= 0 {
+		return nil
+	}
+
+	leaseID, err := e.lease()
+	if err != nil {
+		return err
+	}
+
+	renew := func() ([]string, error) {
+		alive, err := e.client.KeepAliveOnce(leaseID)
+		if err != nil {
+			return nil, err
+		}
+		if !alive {
+			return nil, &lostLockError{key: fmt.Sprintf("etcd lease %d", leaseID)}
+		}
+		return nil, nil
+	}
+	release := func() error {
+		return e.client.Revoke(leaseID)
+	}
+	err = renewPeriodically(e.leaseTTL, renew, release, nil, doneCh)
+	if err != nil {
+		e.resetLease(leaseID)
+	}
+	return err
+}
@@ -0,0 +1,399 @@
+package talcum_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/talcum/src/talcum"
+)
+
+// fakeEtcd is a stand-in for the etcd v3 JSON gateway that supports
+// the requests made by EtcdClient. etcd is not vendored, so an embedded
+// server can't be used; instead the fake decodes requests as strictly
+// as the gateway, rejecting unknown fields and enum names, and
+// evaluates every field of a compare the way etcd does. Set
+// TALCUM_ETCD_ENDPOINTS, e.g. to the etcd of docker-compose.yml, to
+// run the tests against a real etcd instead.
+type fakeEtcd struct {
+	sync.Mutex
+	keys      map[string]*fakeEtcdKey
+	leases    map[string]bool
+	revision  int64
+	nextLease int
+}
+
+type fakeEtcdKey struct {
+	value          string
+	lease          string
+	createRevision int64
+	modRevision    int64
+	version        int64
+}
+
+type fakeEtcdCompare struct {
+	Key            []byte `json:"key"`
+	Result         string `json:"result"`
+	Target         string `json:"target"`
+	CreateRevision string `json:"create_revision"`
+	ModRevision    string `json:"mod_revision"`
+	Version        string `json:"version"`
+	Value          []byte `json:"value"`
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		keys:   make(map[string]*fakeEtcdKey),
+		leases: make(map[string]bool),
+	}
+}
+
+// compare evaluates a compare of a transaction. As in etcd, the result
+// defaults to EQUAL, and a key that does not exist has revisions and a
+// version of zero.
+func (f *fakeEtcd) compare(cmp fakeEtcdCompare) (bool, error) {
+	kv := f.keys[string(cmp.Key)]
+	if kv == nil {
+		kv = &fakeEtcdKey{}
+	}
+
+	var c int
+	switch cmp.Target {
+	case "", "VERSION":
+		c = compareInt(kv.version, cmp.Version)
+	case "CREATE":
+		c = compareInt(kv.createRevision, cmp.CreateRevision)
+	case "MOD":
+		c = compareInt(kv.modRevision, cmp.ModRevision)
+	case "VALUE":
+		c = strings.Compare(kv.value, string(cmp.Value))
+	default:
+		return false, fmt.Errorf("unknown compare target: %q", cmp.Target)
+	}
+
+	switch cmp.Result {
+	case "", "EQUAL":
+		return c == 0, nil
+	case "NOT_EQUAL":
+		return c != 0, nil
+	case "GREATER":
+		return c > 0, nil
+	case "LESS":
+		return c < 0, nil
+	}
+	return false, fmt.Errorf("unknown compare result: %q", cmp.Result)
+}
+
+// compareInt compares a number to an int64 that is encoded as a JSON
+// string, which is omitted if it is zero.
+func compareInt(a int64, encoded string) int {
+	b, _ := strconv.ParseInt(encoded, 10, 64)
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	var req struct {
+		Key     []byte            `json:"key"`
+		ID      string            `json:"ID"`
+		TTL     string            `json:"TTL"`
+		Compare []fakeEtcdCompare `json:"compare"`
+		Success []struct {
+			RequestPut *struct {
+				Key   []byte `json:"key"`
+				Value []byte `json:"value"`
+				Lease string `json:"lease"`
+			} `json:"request_put"`
+			RequestDeleteRange *struct {
+				Key []byte `json:"key"`
+			} `json:"request_delete_range"`
+		} `json:"success"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := map[string]interface{}{}
+	switch r.URL.Path {
+	case "/v3/kv/txn":
+		for _, cmp := range req.Compare {
+			ok, err := f.compare(cmp)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if !ok {
+				json.NewEncoder(w).Encode(resp)
+				return
+			}
+		}
+		for _, op := range req.Success {
+			if op.RequestDeleteRange != nil {
+				delete(f.keys, string(op.RequestDeleteRange.Key))
+				continue
+			}
+			put := op.RequestPut
+			if put == nil {
+				http.Error(w, "unknown request op", http.StatusBadRequest)
+				return
+			}
+			if put.Lease != "" && !f.leases[put.Lease] {
+				http.Error(w, "lease not found", http.StatusNotFound)
+				return
+			}
+			f.revision++
+			kv := f.keys[string(put.Key)]
+			if kv == nil {
+				kv = &fakeEtcdKey{createRevision: f.revision}
+				f.keys[string(put.Key)] = kv
+			}
+			kv.value = string(put.Value)
+			kv.lease = put.Lease
+			kv.modRevision = f.revision
+			kv.version++
+		}
+		resp["succeeded"] = true
+	case "/v3/kv/range":
+		if kv, ok := f.keys[string(req.Key)]; ok {
+			resp["kvs"] = []map[string][]byte{{"key": req.Key, "value": []byte(kv.value)}}
+		}
+	case "/v3/kv/deleterange":
+		delete(f.keys, string(req.Key))
+	case "/v3/lease/grant":
+		f.nextLease++
+		id := strconv.Itoa(f.nextLease)
+		f.leases[id] = true
+		resp["ID"] = id
+	case "/v3/lease/keepalive":
+		if f.leases[req.ID] {
+			resp["result"] = map[string]string{"ID": req.ID, "TTL": "10"}
+		}
+	case "/v3/lease/revoke":
+		delete(f.leases, req.ID)
+		for key, kv := range f.keys {
+			if kv.lease == req.ID {
+				delete(f.keys, key)
+			}
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// newTestEtcdClient returns a client for the etcd at
+// TALCUM_ETCD_ENDPOINTS, or else for a fakeEtcd, which is returned
+// along with it. Keys are prefixed with the test's name so that runs
+// against a real etcd do not collide.
+func newTestEtcdClient(t *testing.T) (*talcum.EtcdClient, *fakeEtcd, string, func()) {
+	prefix := fmt.Sprintf("talcum-test/%s/%d/", t.Name(), time.Now().UnixNano())
+	if endpoints := os.Getenv("TALCUM_ETCD_ENDPOINTS"); endpoints != "" {
+		return talcum.NewEtcdClient(strings.Split(endpoints, ","), nil), nil, prefix, func() {}
+	}
+	etcd := newFakeEtcd()
+	server := httptest.NewServer(etcd)
+	return talcum.NewEtcdClient([]string{server.URL}, nil), etcd, prefix, server.Close
+}
+
+func TestEtcdLocker(t *testing.T) {
+	client, _, prefix, closeFn := newTestEtcdClient(t)
+	defer closeFn()
+
+	locker := talcum.NewEtcdLocker(client, 0)
+	key := prefix + "app/1/abc/0"
+
+	locked, err := locker.Lock(key, []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected key to be locked")
+	}
+
+	locked, err = locker.Lock(key, []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Fatal("expected locked key to stay locked")
+	}
+	value, err := locker.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "1" {
+		t.Fatalf("unexpected value: %s", value)
+	}
+
+	if err := locker.Unlock(key); err != nil {
+		t.Fatal(err)
+	}
+	locked, err = locker.Lock(key, []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected unlocked key to be lockable")
+	}
+	if err := locker.Unlock(key); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEtcdLockerUnlockIf(t *testing.T) {
+	client, _, prefix, closeFn := newTestEtcdClient(t)
+	defer closeFn()
+
+	locker := talcum.NewEtcdLocker(client, 0)
+	key := prefix + "app/1/abc/0"
+	if _, err := locker.Lock(key, []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	unlocked, err := locker.UnlockIf(key, func(value []byte) bool { return string(value) == "2" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := locker.Get(key); unlocked || value == nil {
+		t.Fatal("expected a lock with another value to stay locked")
+	}
+
+	// The key changes after it was read, so the delete fails.
+	unlocked, err = locker.UnlockIf(key, func(value []byte) bool {
+		if err := client.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.PutIfAbsent(key, []byte("2"), 0); err != nil {
+			t.Fatal(err)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := locker.Get(key); unlocked || string(value) != "2" {
+		t.Fatalf("expected a lock that changed to stay locked, got: %s", value)
+	}
+
+	unlocked, err = locker.UnlockIf(key, func(value []byte) bool { return string(value) == "2" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := locker.Get(key); !unlocked || value != nil {
+		t.Fatal("expected the lock to be deleted")
+	}
+}
+
+func TestEtcdLockerLease(t *testing.T) {
+	client, etcd, prefix, closeFn := newTestEtcdClient(t)
+	defer closeFn()
+
+	locker := talcum.NewEtcdLocker(client, 3*time.Second)
+	key := prefix + "app/1/abc/0"
+
+	locked, err := locker.Lock(key, []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected key to be locked")
+	}
+	if etcd != nil && etcd.keys[key].lease == "" {
+		t.Fatal("expected key to be attached to a lease")
+	}
+
+	doneCh := make(chan struct{})
+	close(doneCh)
+	if err := locker.RenewLease(doneCh); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := locker.Get(key); err != nil || value != nil {
+		t.Fatalf("expected key to be deleted when its lease is revoked, got: %s, %v", value, err)
+	}
+}
+
+func TestFakeEtcdCompare(t *testing.T) {
+	etcd := newFakeEtcd()
+	etcd.keys["a"] = &fakeEtcdKey{value: "1", createRevision: 2, modRevision: 2, version: 1}
+
+	for _, test := range []struct {
+		cmp      fakeEtcdCompare
+		expected bool
+	}{
+		{fakeEtcdCompare{Key: []byte("a"), Result: "EQUAL", Target: "CREATE", CreateRevision: "0"}, false},
+		{fakeEtcdCompare{Key: []byte("b"), Result: "EQUAL", Target: "CREATE", CreateRevision: "0"}, true},
+		{fakeEtcdCompare{Key: []byte("b"), Target: "CREATE"}, true},
+		{fakeEtcdCompare{Key: []byte("a"), Result: "NOT_EQUAL", Target: "CREATE", CreateRevision: "0"}, true},
+		{fakeEtcdCompare{Key: []byte("a"), Result: "GREATER", Target: "MOD", ModRevision: "1"}, true},
+		{fakeEtcdCompare{Key: []byte("a"), Result: "EQUAL", Target: "VALUE", Value: []byte("2")}, false},
+	} {
+		ok, err := etcd.compare(test.cmp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.expected {
+			t.Errorf("compare %+v: expected %v, got %v", test.cmp, test.expected, ok)
+		}
+	}
+
+	if _, err := etcd.compare(fakeEtcdCompare{Key: []byte("a"), Result: "EQ"}); err == nil {
+		t.Fatal("expected an unknown result to be rejected")
+	}
+}
+
+func TestEtcdLockerGrantsNewLeaseAfterExpiry(t *testing.T) {
+	etcd := newFakeEtcd()
+	server := httptest.NewServer(etcd)
+	defer server.Close()
+
+	client := talcum.NewEtcdClient([]string{server.URL}, nil)
+	locker := talcum.NewEtcdLocker(client, 3*time.Second)
+
+	if locked, err := locker.Lock("app/1/abc/0", []byte("1")); err != nil || !locked {
+		t.Fatalf("expected key to be locked: %v", err)
+	}
+
+	// The lease expires along with its keys.
+	lease := etcd.keys["app/1/abc/0"].lease
+	if err := client.Revoke(mustParseInt(t, lease)); err != nil {
+		t.Fatal(err)
+	}
+
+	locked, err := locker.Lock("app/1/abc/0", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected key to be locked again")
+	}
+	if etcd.keys["app/1/abc/0"].lease == lease {
+		t.Fatal("expected key to be attached to a new lease")
+	}
+}
+
+func mustParseInt(t *testing.T, s string) int64 {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
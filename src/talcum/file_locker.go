@@ -0,0 +1,77 @@
+package talcum
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// FileLocker can lock keys by creating files under a root directory,
+// e.g. on a volume shared by all actors. A key maps directly onto a
+// path below the root directory.
+type FileLocker struct {
+	root string
+}
+
+// NewFileLocker creates a new FileLocker.
+func NewFileLocker(root string) *FileLocker {
+	return &FileLocker{root: root}
+}
+
+func (f *FileLocker) path(key string) string {
+	return filepath.Join(f.root, filepath.FromSlash(key))
+}
+
+// Lock tries to lock a key, storing value in it, return true if the
+// lock operation was successful.
+func (f *FileLocker) Lock(key string, value []byte) (bool, error) {
+	path := f.path(key)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, err
+	}
+
+	// The value is written to a temporary file first, which is then
+	// linked to the lock path. Linking fails if the path exists, so
+	// the lock is set atomically and always has its full value,
+	// including on NFS.
+	tmp, err := ioutil.TempFile(dir, ".talcum-")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Get returns the value of a key or nil if it is not locked.
+func (f *FileLocker) Get(key string) ([]byte, error) {
+	value, err := ioutil.ReadFile(f.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Unlock releases a key by removing its file.
+func (f *FileLocker) Unlock(key string) error {
+	err := os.Remove(f.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
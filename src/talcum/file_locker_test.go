@@ -0,0 +1,101 @@
+package talcum_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dollarshaveclub/talcum/src/talcum"
+)
+
+func TestFileLocker(t *testing.T) {
+	root, err := ioutil.TempDir("", "talcum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	locker := talcum.NewFileLocker(root)
+
+	locked, err := locker.Lock("app/1/abc/0", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected key to be locked")
+	}
+	value, err := locker.Get("app/1/abc/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "1" {
+		t.Fatalf("unexpected value: %s", value)
+	}
+
+	locked, err = locker.Lock("app/1/abc/0", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Fatal("expected locked key to stay locked")
+	}
+
+	if err := locker.Unlock("app/1/abc/0"); err != nil {
+		t.Fatal(err)
+	}
+	locked, err = locker.Lock("app/1/abc/0", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected unlocked key to be lockable")
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(root, "app", "1", "abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected temporary files to be removed, found: %d files", len(files))
+	}
+}
+
+func TestFileLockerSelect(t *testing.T) {
+	root, err := ioutil.TempDir("", "talcum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      2,
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		selector := talcum.NewSelector(talcumConfig, selectorConfig, talcum.NewFileLocker(root))
+		selection, err := selector.SelectSlot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selection.Random() {
+			t.Fatal("expected a free slot to be locked")
+		}
+	}
+
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, talcum.NewFileLocker(root))
+	selection, err := selector.SelectSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !selection.Random() {
+		t.Fatalf("expected a random selection, got slot: %d", selection.Slot)
+	}
+}
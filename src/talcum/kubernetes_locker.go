@@ -0,0 +1,475 @@
+package talcum
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// claimAnnotation is the Lease annotation the value of a lock is
+	// stored in.
+	claimAnnotation = "talcum.dollarshaveclub.com/claim"
+
+	microTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// Lease is a coordination.k8s.io/v1 Lease.
+type Lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   LeaseMetadata `json:"metadata"`
+	Spec       LeaseSpec     `json:"spec"`
+}
+
+// LeaseMetadata is the object metadata of a Lease.
+type LeaseMetadata struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+}
+
+// LeaseSpec is the spec of a Lease.
+type LeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// expired returns true if the lease has a duration and has not been
+// renewed within it.
+func (l *Lease) expired(now time.Time) bool {
+	if l.Spec.LeaseDurationSeconds <= 0 {
+		return false
+	}
+	renewTime, err := time.Parse(time.RFC3339Nano, l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.After(renewTime.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// KubernetesLeaseClient is the interface to the Lease endpoints of a
+// Kubernetes API server. Create and Update return false if the write
+// conflicted with an existing Lease or a newer version of it, and
+// Get returns nil if the Lease does not exist. DeleteIf returns false
+// if the Lease no longer exists or was changed since resourceVersion.
+type KubernetesLeaseClient interface {
+	Create(lease *Lease) (bool, error)
+	Get(name string) (*Lease, error)
+	Update(lease *Lease) (bool, error)
+	Delete(name string) error
+	DeleteIf(name, resourceVersion string) (bool, error)
+}
+
+// deleteOptions is a meta/v1 DeleteOptions that only lets a delete
+// succeed if the object still has a resource version.
+type deleteOptions struct {
+	APIVersion    string `json:"apiVersion"`
+	Kind          string `json:"kind"`
+	Preconditions struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"preconditions"`
+}
+
+// KubernetesClient is a client for the Lease endpoints of a
+// Kubernetes API server.
+type KubernetesClient struct {
+	host       string
+	namespace  string
+	token      string
+	httpClient *http.Client
+}
+
+// NewKubernetesClient creates a new KubernetesClient that manages
+// Leases in namespace. If token is not empty, it is sent as a bearer
+// token.
+func NewKubernetesClient(host, namespace, token string, httpClient *http.Client) *KubernetesClient {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &KubernetesClient{
+		host:       strings.TrimSuffix(host, "/"),
+		namespace:  namespace,
+		token:      token,
+		httpClient: httpClient,
+	}
+}
+
+// NewInClusterKubernetesClient creates a new KubernetesClient using
+// the service account of the pod it is running in. If namespace is
+// empty, the namespace of the pod is used.
+func NewInClusterKubernetesClient(namespace string) (*KubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster: KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("error reading service account token: %v", err)
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("error reading service account CA: %v", err)
+	}
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("error reading service account namespace: %v", err)
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("error parsing service account CA")
+	}
+	httpClient := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+
+	url := "https://" + net.JoinHostPort(host, port)
+	return NewKubernetesClient(url, namespace, strings.TrimSpace(string(token)), httpClient), nil
+}
+
+func (c *KubernetesClient) url(name string) string {
+	url := fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", c.host, c.namespace)
+	if name != "" {
+		url += "/" + name
+	}
+	return url
+}
+
+// do sends a request and decodes the response into resp, returning
+// the response status code.
+func (c *KubernetesClient) do(method, url string, req, resp interface{}) (int, error) {
+	var body bytes.Buffer
+	if req != nil {
+		if err := json.NewEncoder(&body).Encode(req); err != nil {
+			return 0, err
+		}
+	}
+
+	r, err := http.NewRequest(method, url, &body)
+	if err != nil {
+		return 0, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		r.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.httpClient.Do(r)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusConflict:
+		return res.StatusCode, nil
+	case res.StatusCode >= 300:
+		b, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, fmt.Errorf("kubernetes error: %s: %s", res.Status, b)
+	}
+	if resp != nil {
+		if err := json.NewDecoder(res.Body).Decode(resp); err != nil {
+			return res.StatusCode, err
+		}
+	}
+	return res.StatusCode, nil
+}
+
+// Create creates a Lease, returning false if it already exists.
+func (c *KubernetesClient) Create(lease *Lease) (bool, error) {
+	status, err := c.do("POST", c.url(""), lease, nil)
+	if err != nil {
+		return false, err
+	}
+	return status != http.StatusConflict, nil
+}
+
+// Get returns a Lease or nil if it does not exist.
+func (c *KubernetesClient) Get(name string) (*Lease, error) {
+	var lease Lease
+	status, err := c.do("GET", c.url(name), nil, &lease)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+	return &lease, nil
+}
+
+// Update replaces a Lease, returning false if the Lease was changed
+// since it was read or no longer exists.
+func (c *KubernetesClient) Update(lease *Lease) (bool, error) {
+	status, err := c.do("PUT", c.url(lease.Metadata.Name), lease, nil)
+	if err != nil {
+		return false, err
+	}
+	return status != http.StatusConflict && status != http.StatusNotFound, nil
+}
+
+// Delete deletes a Lease.
+func (c *KubernetesClient) Delete(name string) error {
+	_, err := c.do("DELETE", c.url(name), nil, nil)
+	return err
+}
+
+// DeleteIf deletes a Lease if it was not changed since
+// resourceVersion, returning false otherwise.
+func (c *KubernetesClient) DeleteIf(name, resourceVersion string) (bool, error) {
+	options := deleteOptions{
+		APIVersion: "v1",
+		Kind:       "DeleteOptions",
+	}
+	options.Preconditions.ResourceVersion = resourceVersion
+	status, err := c.do("DELETE", c.url(name), &options, nil)
+	if err != nil {
+		return false, err
+	}
+	return status != http.StatusConflict && status != http.StatusNotFound, nil
+}
+
+var (
+	invalidLeaseNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+	dnsSubdomain          = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+// maxLeaseNameLength is the maximum length of a DNS subdomain.
+const maxLeaseNameLength = 253
+
+// leaseName returns the name of the Lease used to lock key. Lease names
+// must be DNS subdomains, so slashes become dots and other invalid
+// characters become dashes. If the result is still not a DNS
+// subdomain, e.g. because a part of the key starts with a dash or the
+// key is too long, a hash of the key is used instead.
+func leaseName(key string) string {
+	name := strings.Replace(strings.ToLower(key), "/", ".", -1)
+	name = "talcum." + invalidLeaseNameChars.ReplaceAllString(name, "-")
+	if len(name) <= maxLeaseNameLength && dnsSubdomain.MatchString(name) {
+		return name
+	}
+	return fmt.Sprintf("talcum.%x", sha256.Sum256([]byte(key)))
+}
+
+// KubernetesLocker can lock keys using Kubernetes Leases as a backend,
+// with one Lease per slot.
+type KubernetesLocker struct {
+	client         KubernetesLeaseClient
+	holderIdentity string
+	leaseDuration  time.Duration
+
+	mu   sync.Mutex
+	held map[string][]byte
+
+	lossNotifier
+}
+
+// NewKubernetesLocker creates a new KubernetesLocker. If
+// leaseDuration is positive, Leases that are not renewed with
+// RenewLeases within it can be taken over by other actors.
+func NewKubernetesLocker(client KubernetesLeaseClient, holderIdentity string, leaseDuration time.Duration) *KubernetesLocker {
+	return &KubernetesLocker{
+		client:         client,
+		holderIdentity: holderIdentity,
+		leaseDuration:  leaseDuration,
+		held:           make(map[string][]byte),
+	}
+}
+
+// Lock tries to lock a key, storing value in it, return true if the
+// lock operation was successful. An expired Lease is taken over.
+func (k *KubernetesLocker) Lock(key string, value []byte) (bool, error) {
+	name := leaseName(key)
+	now := time.Now().UTC()
+
+	lease := &Lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata: LeaseMetadata{
+			Name:        name,
+			Annotations: map[string]string{claimAnnotation: string(value)},
+		},
+		Spec: LeaseSpec{
+			HolderIdentity:       k.holderIdentity,
+			LeaseDurationSeconds: int(k.leaseDuration / time.Second),
+			AcquireTime:          now.Format(microTimeFormat),
+			RenewTime:            now.Format(microTimeFormat),
+		},
+	}
+
+	created, err := k.client.Create(lease)
+	if err != nil {
+		return false, err
+	}
+	if !created {
+		existing, err := k.client.Get(name)
+		if err != nil {
+			return false, err
+		}
+		if existing == nil || !existing.expired(now) {
+			return false, nil
+		}
+
+		// The previous holder did not renew the Lease in time.
+		lease.Metadata.ResourceVersion = existing.Metadata.ResourceVersion
+		lease.Spec.LeaseTransitions = existing.Spec.LeaseTransitions + 1
+		updated, err := k.client.Update(lease)
+		if err != nil || !updated {
+			return false, err
+		}
+	}
+
+	k.mu.Lock()
+	k.held[name] = value
+	k.mu.Unlock()
+	return true, nil
+}
+
+// Get returns the value of a key or nil if it is not locked, i.e. if
+// its Lease does not exist or has expired.
+func (k *KubernetesLocker) Get(key string) ([]byte, error) {
+	lease, err := k.client.Get(leaseName(key))
+	if err != nil || lease == nil || lease.expired(time.Now()) {
+		return nil, err
+	}
+	return []byte(lease.Metadata.Annotations[claimAnnotation]), nil
+}
+
+// Unlock releases a key by deleting its Lease.
+func (k *KubernetesLocker) Unlock(key string) error {
+	name := leaseName(key)
+	if err := k.client.Delete(name); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	delete(k.held, name)
+	k.mu.Unlock()
+	return nil
+}
+
+// UnlockIf implements CompareUnlocker by deleting the key's Lease with
+// a precondition on the resource version it was read at.
+func (k *KubernetesLocker) UnlockIf(key string, held func(value []byte) bool) (bool, error) {
+	name := leaseName(key)
+	lease, err := k.client.Get(name)
+	if err != nil {
+		return false, err
+	}
+	if lease == nil || lease.expired(time.Now()) || !held([]byte(lease.Metadata.Annotations[claimAnnotation])) {
+		return false, nil
+	}
+	deleted, err := k.client.DeleteIf(name, lease.Metadata.ResourceVersion)
+	if err != nil {
+		return false, err
+	}
+
+	k.mu.Lock()
+	delete(k.held, name)
+	k.mu.Unlock()
+	return deleted, nil
+}
+
+// holds returns true if the locker still holds a Lease with value.
+func (k *KubernetesLocker) holds(lease *Lease, value []byte) bool {
+	return lease != nil &&
+		lease.Spec.HolderIdentity == k.holderIdentity &&
+		lease.Metadata.Annotations[claimAnnotation] == string(value)
+}
+
+// Renew implements Renewer using RenewLeases.
+func (k *KubernetesLocker) Renew(doneCh chan struct{}) error {
+	return k.RenewLeases(doneCh)
+}
+
+// RenewLeases periodically renews the Leases held by the locker until
+// doneCh is closed, after which the Leases are deleted. It returns
+// immediately if Leases do not expire.
+func (k *KubernetesLocker) RenewLeases(doneCh chan struct{}) error {
+	if k.leaseDuration <= 0 {
+		return nil
+	}
+
+	return renewPeriodically(k.leaseDuration, k.renew, k.release, &k.lossNotifier, doneCh)
+}
+
+// release deletes the Leases that are still held by the locker,
+// leaving alone the ones that expired and were taken over.
+func (k *KubernetesLocker) release() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for name, value := range k.held {
+		lease, err := k.client.Get(name)
+		if err != nil {
+			return err
+		}
+		if k.holds(lease, value) {
+			if _, err := k.client.DeleteIf(name, lease.Metadata.ResourceVersion); err != nil {
+				return err
+			}
+		}
+		delete(k.held, name)
+	}
+	return nil
+}
+
+// Forget implements Forgetter.
+func (k *KubernetesLocker) Forget(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.held, leaseName(key))
+}
+
+func (k *KubernetesLocker) renew() ([]string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var lost []string
+	for name, value := range k.held {
+		lease, err := k.client.Get(name)
+		if err != nil {
+			return lost, err
+		}
+		if !k.holds(lease, value) {
+			delete(k.held, name)
+			lost = append(lost, name)
+			continue
+		}
+
+		lease.Spec.RenewTime = time.Now().UTC().Format(microTimeFormat)
+		updated, err := k.client.Update(lease)
+		if err != nil {
+			return lost, err
+		}
+		if !updated {
+			delete(k.held, name)
+			lost = append(lost, name)
+		}
+	}
+	return lost, nil
+}
@@ -0,0 +1,308 @@
+package talcum_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/talcum/src/talcum"
+)
+
+const leasesPath = "/apis/coordination.k8s.io/v1/namespaces/test/leases"
+
+// fakeKubernetes is a stand-in for the Lease endpoints of a Kubernetes
+// API server. KubernetesClient talks to the REST API directly so that
+// client-go does not have to be vendored, which also means the
+// client-go fake clientset can't exercise it. Instead, the fake
+// rejects requests the way the API server does, e.g. Leases whose
+// names are not DNS subdomains.
+type fakeKubernetes struct {
+	sync.Mutex
+	leases  map[string]*talcum.Lease
+	version int
+}
+
+func newFakeKubernetes() *fakeKubernetes {
+	return &fakeKubernetes{
+		leases: make(map[string]*talcum.Lease),
+	}
+}
+
+func (f *fakeKubernetes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	if !strings.HasPrefix(r.URL.Path, leasesPath) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, leasesPath), "/")
+
+	var lease talcum.Lease
+	if r.Method == "POST" || r.Method == "PUT" {
+		if err := json.NewDecoder(r.Body).Decode(&lease); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var options struct {
+		APIVersion    string `json:"apiVersion"`
+		Kind          string `json:"kind"`
+		Preconditions struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"preconditions"`
+	}
+	if r.Method == "DELETE" {
+		if err := json.NewDecoder(r.Body).Decode(&options); err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if options.Kind != "" && (options.APIVersion != "v1" || options.Kind != "DeleteOptions") {
+			http.Error(w, "unexpected kind", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if r.Method == "POST" || r.Method == "PUT" {
+		if lease.APIVersion != "coordination.k8s.io/v1" || lease.Kind != "Lease" {
+			http.Error(w, "unexpected kind", http.StatusBadRequest)
+			return
+		}
+		if r.Method == "PUT" && lease.Metadata.Name != name {
+			http.Error(w, "name does not match", http.StatusBadRequest)
+			return
+		}
+		if !validLeaseName(lease.Metadata.Name) {
+			http.Error(w, "invalid name", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+
+	existing, ok := f.leases[name]
+	switch r.Method {
+	case "POST":
+		if _, ok := f.leases[lease.Metadata.Name]; ok {
+			http.Error(w, "already exists", http.StatusConflict)
+			return
+		}
+		f.store(&lease)
+	case "GET":
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(existing)
+	case "PUT":
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if lease.Metadata.ResourceVersion != existing.Metadata.ResourceVersion {
+			http.Error(w, "conflict", http.StatusConflict)
+			return
+		}
+		f.store(&lease)
+	case "DELETE":
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if rv := options.Preconditions.ResourceVersion; rv != "" && rv != existing.Metadata.ResourceVersion {
+			http.Error(w, "precondition failed", http.StatusConflict)
+			return
+		}
+		delete(f.leases, name)
+	}
+}
+
+// validLeaseName returns true if name is a DNS subdomain, as the API
+// server requires of object names.
+func validLeaseName(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (f *fakeKubernetes) store(lease *talcum.Lease) {
+	f.version++
+	lease.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.leases[lease.Metadata.Name] = lease
+}
+
+func TestKubernetesLocker(t *testing.T) {
+	kubernetes := newFakeKubernetes()
+	server := httptest.NewServer(kubernetes)
+	defer server.Close()
+
+	client := talcum.NewKubernetesClient(server.URL, "test", "", nil)
+	locker := talcum.NewKubernetesLocker(client, "actor-1", 0)
+	other := talcum.NewKubernetesLocker(client, "actor-2", 0)
+
+	locked, err := locker.Lock("My_App/1/abc/0", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected key to be locked")
+	}
+	lease, ok := kubernetes.leases["talcum.my-app.1.abc.0"]
+	if !ok {
+		t.Fatalf("expected a lease to be created, got: %v", kubernetes.leases)
+	}
+	if lease.Spec.HolderIdentity != "actor-1" {
+		t.Fatalf("unexpected holder: %s", lease.Spec.HolderIdentity)
+	}
+	if value, err := other.Get("My_App/1/abc/0"); err != nil || string(value) != "1" {
+		t.Fatalf("unexpected value: %s, %v", value, err)
+	}
+
+	locked, err = other.Lock("My_App/1/abc/0", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Fatal("expected locked key to stay locked")
+	}
+
+	if err := locker.Unlock("My_App/1/abc/0"); err != nil {
+		t.Fatal(err)
+	}
+	locked, err = other.Lock("My_App/1/abc/0", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected unlocked key to be lockable")
+	}
+}
+
+func TestKubernetesLockerTakesOverExpiredLease(t *testing.T) {
+	kubernetes := newFakeKubernetes()
+	server := httptest.NewServer(kubernetes)
+	defer server.Close()
+
+	client := talcum.NewKubernetesClient(server.URL, "test", "", nil)
+	locker := talcum.NewKubernetesLocker(client, "actor-1", 10*time.Second)
+	other := talcum.NewKubernetesLocker(client, "actor-2", 10*time.Second)
+
+	locked, err := locker.Lock("app/1/abc/0", []byte("1"))
+	if err != nil || !locked {
+		t.Fatalf("expected key to be locked: %v", err)
+	}
+	locked, err = other.Lock("app/1/abc/0", []byte("1"))
+	if err != nil || locked {
+		t.Fatalf("expected lease to be held: %v", err)
+	}
+
+	lease := kubernetes.leases["talcum.app.1.abc.0"]
+	lease.Spec.RenewTime = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)
+
+	locked, err = other.Lock("app/1/abc/0", []byte("1"))
+	if err != nil || !locked {
+		t.Fatalf("expected expired lease to be taken over: %v", err)
+	}
+	lease = kubernetes.leases["talcum.app.1.abc.0"]
+	if lease.Spec.HolderIdentity != "actor-2" || lease.Spec.LeaseTransitions != 1 {
+		t.Fatalf("unexpected lease spec: %+v", lease.Spec)
+	}
+}
+
+func TestKubernetesLockerLeaseNames(t *testing.T) {
+	kubernetes := newFakeKubernetes()
+	server := httptest.NewServer(kubernetes)
+	defer server.Close()
+
+	client := talcum.NewKubernetesClient(server.URL, "test", "", nil)
+	locker := talcum.NewKubernetesLocker(client, "actor-1", 0)
+
+	for _, key := range []string{
+		"_x/1/abc/0",
+		"app//1/abc/0",
+		"app-/1/abc/0",
+		strings.Repeat("a", 300) + "/1/abc/0",
+	} {
+		locked, err := locker.Lock(key, []byte("1"))
+		if err != nil {
+			t.Fatalf("key %s: %v", key, err)
+		}
+		if !locked {
+			t.Fatalf("expected key to be locked: %s", key)
+		}
+		if value, err := locker.Get(key); err != nil || string(value) != "1" {
+			t.Fatalf("key %s: unexpected value: %s, %v", key, value, err)
+		}
+	}
+	if len(kubernetes.leases) != 4 {
+		t.Fatalf("expected a lease per key, got: %d", len(kubernetes.leases))
+	}
+}
+
+func TestKubernetesLockerLeavesLeasesTakenOver(t *testing.T) {
+	kubernetes := newFakeKubernetes()
+	server := httptest.NewServer(kubernetes)
+	defer server.Close()
+
+	client := talcum.NewKubernetesClient(server.URL, "test", "", nil)
+	locker := talcum.NewKubernetesLocker(client, "actor-1", 10*time.Second)
+	other := talcum.NewKubernetesLocker(client, "actor-2", 10*time.Second)
+
+	if locked, err := locker.Lock("app/1/abc/0", []byte("1")); err != nil || !locked {
+		t.Fatalf("expected key to be locked: %v", err)
+	}
+
+	// The lease expires and is taken over by another actor.
+	lease := kubernetes.leases["talcum.app.1.abc.0"]
+	lease.Spec.RenewTime = time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)
+	if locked, err := other.Lock("app/1/abc/0", []byte("2")); err != nil || !locked {
+		t.Fatalf("expected expired lease to be taken over: %v", err)
+	}
+
+	unlocked, err := locker.UnlockIf("app/1/abc/0", func(value []byte) bool { return string(value) == "1" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlocked {
+		t.Fatal("expected a lease taken over to stay locked")
+	}
+
+	doneCh := make(chan struct{})
+	close(doneCh)
+	if err := locker.RenewLeases(doneCh); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := other.Get("app/1/abc/0"); err != nil || string(value) != "2" {
+		t.Fatalf("expected the other actor's lease to be left alone, got: %s, %v", value, err)
+	}
+
+	// A lease that changed since it was read is not deleted.
+	rv := kubernetes.leases["talcum.app.1.abc.0"].Metadata.ResourceVersion
+	kubernetes.store(kubernetes.leases["talcum.app.1.abc.0"])
+	if deleted, err := client.DeleteIf("talcum.app.1.abc.0", rv); err != nil || deleted {
+		t.Fatalf("expected the delete to fail its precondition: %v", err)
+	}
+
+	unlocked, err = other.UnlockIf("app/1/abc/0", func(value []byte) bool { return string(value) == "2" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unlocked || kubernetes.leases["talcum.app.1.abc.0"] != nil {
+		t.Fatal("expected the lease to be deleted")
+	}
+}
@@ -0,0 +1,268 @@
+package talcum
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// OverflowPolicy decides what happens to an actor when every slot is
+// taken.
+type OverflowPolicy string
+
+const (
+	// OverflowRandom returns a random entry, as SelectRandom does.
+	OverflowRandom OverflowPolicy = "random"
+	// OverflowFail keeps an entry from being duplicated. If no
+	// other entry can be, ErrAllSlotsTaken is returned.
+	OverflowFail OverflowPolicy = "fail"
+	// OverflowBlock keeps an entry from being duplicated. If no
+	// other entry can be, the actor waits until a slot frees up or
+	// Config.OverflowTimeout passes, in which case ErrAllSlotsTaken
+	// is returned.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowLeastRecent returns the entry that an actor overflowed
+	// into least recently.
+	OverflowLeastRecent OverflowPolicy = "least-recent"
+	// OverflowSpare returns the entry marked as Spare.
+	OverflowSpare OverflowPolicy = "spare"
+)
+
+// ErrAllSlotsTaken is returned when every slot is taken and the
+// overflow policy does not allow selecting an entry anyway.
+var ErrAllSlotsTaken = errors.New("all slots are taken")
+
+// ErrNotEligible is returned when the actor's labels do not meet the
+// requirements of any entry.
+var ErrNotEligible = errors.New("actor is not eligible for any role")
+
+// overflowPollInterval is how often OverflowBlock tries to lock a slot
+// again.
+var overflowPollInterval = time.Second
+
+// ParseOverflowPolicy parses the name of an overflow policy. An empty
+// name is OverflowRandom.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(name); policy {
+	case "":
+		return OverflowRandom, nil
+	case OverflowRandom, OverflowFail, OverflowBlock, OverflowLeastRecent, OverflowSpare:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy: %s", name)
+	}
+}
+
+// Spare returns the entry marked as Spare or nil if there is no such
+// entry.
+func (s SelectorConfig) Spare() *SelectorEntry {
+	for _, entry := range s {
+		if entry.Spare {
+			return entry
+		}
+	}
+	return nil
+}
+
+// overflowPolicy returns the policy applied to actors that overflow
+// into an entry.
+func (s *Selector) overflowPolicy(entry *SelectorEntry) (OverflowPolicy, error) {
+	if entry.Overflow != "" {
+		return ParseOverflowPolicy(string(entry.Overflow))
+	}
+	return ParseOverflowPolicy(string(s.talcumConfig.Overflow))
+}
+
+// duplicable returns true if actors may overflow into an entry with
+// the given policy, i.e. if the entry may be held by more actors than
+// it has slots.
+func duplicable(policy OverflowPolicy) bool {
+	return policy != OverflowFail && policy != OverflowBlock
+}
+
+// SelectDuplicable is like SelectRandom, but leaves out the entries
+// whose overflow policy forbids duplicating them, so that it can
+// choose a role when no slot can be locked, e.g. because the locker
+// is unreachable.
+func (s *Selector) SelectDuplicable() *SelectorEntry {
+	return s.selectRandom(func(entry *SelectorEntry) bool {
+		policy, err := s.overflowPolicy(entry)
+		return err == nil && duplicable(policy)
+	})
+}
+
+// overflow is called when every slot is taken. An entry is chosen
+// randomly as before, leaving out the entries whose overflow policy
+// forbids duplicating them, and the policy of the chosen entry decides
+// what is returned instead. If every entry is left out, the actor
+// waits for a slot if any of them blocks, and fails otherwise.
+func (s *Selector) overflow() (*Selection, error) {
+	policies := make(map[*SelectorEntry]OverflowPolicy)
+	blocking := false
+	for _, entry := range s.selectorConfig {
+		if !s.Eligible(entry) {
+			continue
+		}
+		policy, err := s.overflowPolicy(entry)
+		if err != nil {
+			return nil, err
+		}
+		policies[entry] = policy
+		if policy == OverflowBlock && entry.weight() > 0 {
+			blocking = true
+		}
+	}
+	if len(policies) == 0 {
+		return nil, ErrNotEligible
+	}
+
+	entry := s.selectRandom(func(entry *SelectorEntry) bool {
+		return duplicable(policies[entry])
+	})
+	if entry == nil {
+		if !blocking {
+			return nil, ErrAllSlotsTaken
+		}
+		if s.locker == nil {
+			return nil, fmt.Errorf("overflow policy %s requires a locker", OverflowBlock)
+		}
+		if s.talcumConfig.DebugMode {
+			log.Printf("No role can be duplicated, waiting for a slot")
+		}
+		return s.block()
+	}
+
+	policy := policies[entry]
+	if s.talcumConfig.DebugMode {
+		log.Printf("Overflowing into role %s with policy: %s", entry.RoleName, policy)
+	}
+	switch policy {
+	case OverflowLeastRecent:
+		if s.locker == nil {
+			return nil, fmt.Errorf("overflow policy %s requires a locker", policy)
+		}
+		var err error
+		entry, err = s.leastRecent()
+		if err != nil {
+			return nil, err
+		}
+	case OverflowSpare:
+		entry = s.selectorConfig.Spare()
+		if entry == nil {
+			return nil, errors.New("overflow policy spare requires an entry marked as spare")
+		}
+		if !s.Eligible(entry) {
+			return nil, ErrNotEligible
+		}
+	}
+	return &Selection{
+		Entry: entry,
+		Slot:  -1,
+	}, nil
+}
+
+// block tries to lock a slot until one frees up or the overflow
+// timeout passes.
+func (s *Selector) block() (*Selection, error) {
+	var deadline time.Time
+	if s.talcumConfig.OverflowTimeout > 0 {
+		deadline = time.Now().Add(s.talcumConfig.OverflowTimeout)
+	}
+
+	for {
+		wait := overflowPollInterval
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return nil, ErrAllSlotsTaken
+			}
+			if remaining < wait {
+				wait = remaining
+			}
+		}
+		if s.talcumConfig.DebugMode {
+			log.Printf("Waiting for a slot to free up")
+		}
+		if err := s.sleep(wait); err != nil {
+			return nil, err
+		}
+
+		selection, err := s.lockFree(nil)
+		if err != nil || selection != nil {
+			return selection, err
+		}
+	}
+}
+
+// overflowKey returns the key that records when an actor last
+// overflowed into an entry.
+func (s *Selector) overflowKey(entry *SelectorEntry) string {
+	hash := sha256.Sum256([]byte(entry.RoleName))
+	return fmt.Sprintf("%soverflow/%x", s.keyPrefix(), hash[:10])
+}
+
+// leastRecent returns the entry that an actor overflowed into least
+// recently and records that the current actor overflowed into it.
+// Entries that were never overflowed into come first. Only eligible
+// entries with a positive weight whose policy is OverflowRandom or
+// OverflowLeastRecent are considered, so that e.g. an entry that fails
+// on overflow is never duplicated.
+func (s *Selector) leastRecent() (*SelectorEntry, error) {
+	var best *SelectorEntry
+	var bestAt time.Time
+	for _, i := range rand.Perm(len(s.selectorConfig)) {
+		entry := s.selectorConfig[i]
+		if entry.weight() <= 0 || !s.Eligible(entry) {
+			continue
+		}
+		policy, err := s.overflowPolicy(entry)
+		if err != nil {
+			return nil, err
+		}
+		if policy != OverflowRandom && policy != OverflowLeastRecent {
+			continue
+		}
+
+		value, err := s.locker.Get(s.overflowKey(entry))
+		if err != nil {
+			return nil, err
+		}
+		var at time.Time
+		if claim, err := ParseClaim(value); value != nil && err == nil {
+			at = claim.ClaimedAt
+		}
+		if best == nil || at.Before(bestAt) {
+			best, bestAt = entry, at
+		}
+	}
+	if best == nil {
+		return nil, ErrAllSlotsTaken
+	}
+
+	// The record is replaced rather than updated in place since
+	// lockers can only set keys that are not locked. Concurrent
+	// actors may both pick the same entry, which only makes the
+	// spreading less even.
+	key := s.overflowKey(best)
+	value, err := json.Marshal(s.newClaim(best, -1))
+	if err != nil {
+		return nil, err
+	}
+	if err := s.locker.Unlock(key); err != nil {
+		return nil, err
+	}
+	if _, err := s.locker.Lock(key, value); err != nil {
+		return nil, err
+	}
+	// The record is not kept alive, since other actors replace it,
+	// so it expires along with locks that expire, after which the
+	// entry counts as never overflowed into.
+	if forgetter, ok := s.locker.(Forgetter); ok {
+		forgetter.Forget(key)
+	}
+	return best, nil
+}
@@ -0,0 +1,56 @@
+package talcum
+
+import "log"
+
+// Rebalance tries to move selections that were chosen randomly, after
+// every slot was taken, into slots that have been freed since. At
+// most max selections are moved, so that actors calling Rebalance
+// periodically do not all switch roles at once. It returns true if
+// any selection was moved. In rendezvous mode, selections are never
+// moved since slots are not locked.
+func (s *Selector) Rebalance(selections []*Selection, max int) ([]*Selection, bool, error) {
+	if len(s.talcumConfig.Members) > 0 {
+		return selections, false, nil
+	}
+
+	held := make(map[string]bool)
+	roles := make(map[string]bool)
+	for _, selection := range selections {
+		if !selection.Random() {
+			held[s.lockKey(selection.Entry, selection.Slot)] = true
+			roles[selection.Entry.RoleName] = true
+		}
+	}
+	skip := func(entryLock *entryLock) bool {
+		if held[s.lockKey(entryLock.selectorEntry, entryLock.lockValue)] {
+			return true
+		}
+		return s.talcumConfig.DistinctRoles && roles[entryLock.selectorEntry.RoleName]
+	}
+
+	next := make([]*Selection, 0, len(selections))
+	moved := 0
+	var err error
+	for _, selection := range selections {
+		if !selection.Random() || moved >= max || err != nil {
+			next = append(next, selection)
+			continue
+		}
+
+		var claimed *Selection
+		claimed, err = s.claim(skip)
+		if err != nil || claimed == nil {
+			next = append(next, selection)
+			continue
+		}
+
+		if s.talcumConfig.DebugMode {
+			log.Printf("Moved from role %s to role %s, slot %d", selection.Entry.RoleName, claimed.Entry.RoleName, claimed.Slot)
+		}
+		held[s.lockKey(claimed.Entry, claimed.Slot)] = true
+		roles[claimed.Entry.RoleName] = true
+		next = append(next, claimed)
+		moved++
+	}
+	return s.sortSelections(next), moved > 0, err
+}
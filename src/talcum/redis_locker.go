@@ -0,0 +1,189 @@
+package talcum
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// renewScript extends the expiry of a key if it still holds the
+// value the locker set.
+var renewScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// unlockScript deletes a key if it still holds the value the locker
+// set, so that a lock that expired and was taken over by another
+// actor is left alone.
+var unlockScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// RedisLocker can lock keys using Redis as a backend.
+type RedisLocker struct {
+	pool *redis.Pool
+	ttl  time.Duration
+
+	mu   sync.Mutex
+	held map[string][]byte
+
+	lossNotifier
+}
+
+// NewRedisLocker creates a new RedisLocker. If ttl is positive, locks
+// expire unless they are renewed with RenewLocks.
+func NewRedisLocker(pool *redis.Pool, ttl time.Duration) *RedisLocker {
+	return &RedisLocker{
+		pool: pool,
+		ttl:  ttl,
+		held: make(map[string][]byte),
+	}
+}
+
+// Lock tries to lock a key, storing value in it, return true if the
+// lock operation was successful.
+func (r *RedisLocker) Lock(key string, value []byte) (bool, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	args := redis.Args{key, value, "NX"}
+	if r.ttl > 0 {
+		args = args.Add("PX", int64(r.ttl/time.Millisecond))
+	}
+	_, err := redis.String(conn.Do("SET", args...))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	r.held[key] = value
+	r.mu.Unlock()
+	return true, nil
+}
+
+// Get returns the value of a key or nil if it is not locked.
+func (r *RedisLocker) Get(key string) ([]byte, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	value, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Unlock releases a key by deleting it.
+func (r *RedisLocker) Unlock(key string) error {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("DEL", key); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	delete(r.held, key)
+	r.mu.Unlock()
+	return nil
+}
+
+// UnlockIf implements CompareUnlocker by deleting the key with a
+// script that compares its value to the one that was read.
+func (r *RedisLocker) UnlockIf(key string, held func(value []byte) bool) (bool, error) {
+	value, err := r.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if value == nil || !held(value) {
+		return false, nil
+	}
+	return r.unlock(key, value)
+}
+
+// unlock deletes a key if it still has value.
+func (r *RedisLocker) unlock(key string, value []byte) (bool, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	deleted, err := redis.Int(unlockScript.Do(conn, key, value))
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	delete(r.held, key)
+	r.mu.Unlock()
+	return deleted > 0, nil
+}
+
+// Renew implements Renewer using RenewLocks.
+func (r *RedisLocker) Renew(doneCh chan struct{}) error {
+	return r.RenewLocks(doneCh)
+}
+
+// RenewLocks periodically extends the expiry of the locks set by the
+// locker until doneCh is closed, after which the locks are
+// deleted. It returns immediately if locks do not expire.
+func (r *RedisLocker) RenewLocks(doneCh chan struct{}) error {
+	if r.ttl <= 0 {
+		return nil
+	}
+
+	return renewPeriodically(r.ttl, r.renew, r.release, &r.lossNotifier, doneCh)
+}
+
+// release deletes the locks set by the locker that still hold the
+// locker's values.
+func (r *RedisLocker) release() error {
+	r.mu.Lock()
+	held := make(map[string][]byte, len(r.held))
+	for key, value := range r.held {
+		held[key] = value
+	}
+	r.mu.Unlock()
+
+	for key, value := range held {
+		if _, err := r.unlock(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forget implements Forgetter.
+func (r *RedisLocker) Forget(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.held, key)
+}
+
+func (r *RedisLocker) renew() ([]string, error) {
+	conn := r.pool.Get()
+	defer conn.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var lost []string
+	for key, value := range r.held {
+		renewed, err := redis.Int(renewScript.Do(conn, key, value, int64(r.ttl/time.Millisecond)))
+		if err != nil {
+			return lost, err
+		}
+		if renewed == 0 {
+			delete(r.held, key)
+			lost = append(lost, key)
+		}
+	}
+	return lost, nil
+}
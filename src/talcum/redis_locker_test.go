@@ -0,0 +1,187 @@
+package talcum_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/dollarshaveclub/talcum/src/talcum"
+	"github.com/gomodule/redigo/redis"
+)
+
+func newTestRedisPool(t *testing.T) (*miniredis.Miniredis, *redis.Pool) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", server.Addr())
+		},
+	}
+	return server, pool
+}
+
+func TestRedisLocker(t *testing.T) {
+	server, pool := newTestRedisPool(t)
+	defer server.Close()
+	defer pool.Close()
+
+	locker := talcum.NewRedisLocker(pool, 0)
+
+	locked, err := locker.Lock("app/1/abc/0", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected key to be locked")
+	}
+	if value, err := locker.Get("app/1/abc/0"); err != nil || string(value) != "1" {
+		t.Fatalf("unexpected value: %s, %v", value, err)
+	}
+
+	locked, err = locker.Lock("app/1/abc/0", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Fatal("expected locked key to stay locked")
+	}
+
+	if err := locker.Unlock("app/1/abc/0"); err != nil {
+		t.Fatal(err)
+	}
+	locked, err = locker.Lock("app/1/abc/0", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected unlocked key to be lockable")
+	}
+}
+
+func TestRedisLockerExpiry(t *testing.T) {
+	server, pool := newTestRedisPool(t)
+	defer server.Close()
+	defer pool.Close()
+
+	locker := talcum.NewRedisLocker(pool, 10*time.Second)
+
+	locked, err := locker.Lock("app/1/abc/0", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected key to be locked")
+	}
+	if ttl := server.TTL("app/1/abc/0"); ttl != 10*time.Second {
+		t.Fatalf("unexpected TTL: %v", ttl)
+	}
+
+	server.FastForward(11 * time.Second)
+	locked, err = locker.Lock("app/1/abc/0", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected expired key to be lockable")
+	}
+
+	doneCh := make(chan struct{})
+	close(doneCh)
+	if err := locker.RenewLocks(doneCh); err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists("app/1/abc/0") {
+		t.Fatal("expected held keys to be deleted")
+	}
+}
+
+func TestRedisLockerLeavesKeysTakenOver(t *testing.T) {
+	server, pool := newTestRedisPool(t)
+	defer server.Close()
+	defer pool.Close()
+
+	a := talcum.NewRedisLocker(pool, time.Second)
+	b := talcum.NewRedisLocker(pool, time.Second)
+	if locked, err := a.Lock("app/1/abc/0", []byte("a")); err != nil || !locked {
+		t.Fatalf("expected key to be locked: %v", err)
+	}
+
+	// The lock expires and is taken over by another actor.
+	server.FastForward(2 * time.Second)
+	if locked, err := b.Lock("app/1/abc/0", []byte("b")); err != nil || !locked {
+		t.Fatalf("expected expired key to be lockable: %v", err)
+	}
+
+	unlocked, err := a.UnlockIf("app/1/abc/0", func(value []byte) bool { return string(value) == "a" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlocked {
+		t.Fatal("expected a key taken over to stay locked")
+	}
+
+	doneCh := make(chan struct{})
+	close(doneCh)
+	if err := a.RenewLocks(doneCh); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := b.Get("app/1/abc/0"); err != nil || string(value) != "b" {
+		t.Fatalf("expected the other actor's lock to be left alone, got: %s, %v", value, err)
+	}
+}
+
+func TestRedisLockerKeepsRenewingAfterLoss(t *testing.T) {
+	server, pool := newTestRedisPool(t)
+	defer server.Close()
+	defer pool.Close()
+
+	locker := talcum.NewRedisLocker(pool, 3*time.Second)
+	for _, key := range []string{"app/1/abc/0", "app/1/abc/1", "app/1/overflow/abc"} {
+		if locked, err := locker.Lock(key, []byte("1")); err != nil || !locked {
+			t.Fatalf("expected key %s to be locked: %v", key, err)
+		}
+	}
+	locker.Forget("app/1/overflow/abc")
+
+	lostCh := make(chan string)
+	locker.NotifyLost(lostCh)
+	doneCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- locker.RenewLocks(doneCh)
+	}()
+
+	// The first lock is taken over by another actor, and the
+	// record that was forgotten is replaced.
+	server.Set("app/1/abc/0", "2")
+	server.Set("app/1/overflow/abc", "2")
+	server.SetTTL("app/1/abc/1", time.Second)
+	select {
+	case key := <-lostCh:
+		if key != "app/1/abc/0" {
+			t.Fatalf("unexpected lost key: %s", key)
+		}
+	case err := <-errCh:
+		t.Fatalf("expected renewal to go on, got: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the lost lock to be reported")
+	}
+	if ttl := server.TTL("app/1/abc/1"); ttl != 3*time.Second {
+		t.Fatalf("expected the other lock to be renewed, TTL: %v", ttl)
+	}
+
+	close(doneCh)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists("app/1/abc/1") {
+		t.Fatal("expected held keys to be deleted")
+	}
+	for _, key := range []string{"app/1/abc/0", "app/1/overflow/abc"} {
+		if value, _ := server.Get(key); value != "2" {
+			t.Fatalf("expected key %s to be left alone, got: %s", key, value)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package talcum
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// Assign assigns every slot to one of members using rendezvous
+// (highest random weight) hashing, so that every actor computes the
+// same assignment without a Locker. Each member scores each slot with
+// a hash of the member ID and the slot's key, and slots go to the
+// members with the highest scores first, with no member holding more
+// than ceil(slots/members) slots. When a member joins or leaves, the
+// slots it gains or loses move along with a few others that keep the
+// assignment balanced, while most slots stay with their member.
+//
+// Labels and zones are not taken into account since the labels and
+// zones of other members are unknown. The selections of each member
+// are sorted like those returned by SelectManySlots.
+func (s *Selector) Assign(members []string) map[string][]*Selection {
+	if len(members) == 0 {
+		return make(map[string][]*Selection)
+	}
+	slots := len(s.selectorConfig.entryLocks())
+	return s.assign(members, (slots+len(members)-1)/len(members))
+}
+
+// assign is like Assign, but no member holds more than capacity
+// slots.
+func (s *Selector) assign(members []string, capacity int) map[string][]*Selection {
+	assignment := make(map[string][]*Selection)
+	entryLocks := s.selectorConfig.entryLocks()
+
+	type pair struct {
+		member    string
+		entryLock *entryLock
+		score     uint64
+	}
+	var pairs []pair
+	for _, entryLock := range entryLocks {
+		key := s.lockKey(entryLock.selectorEntry, entryLock.lockValue)
+		for _, member := range members {
+			pairs = append(pairs, pair{member, entryLock, rendezvousScore(member, key)})
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return pairs[i].score > pairs[j].score
+	})
+
+	assigned := make(map[*entryLock]bool)
+	for _, p := range pairs {
+		if assigned[p.entryLock] || len(assignment[p.member]) >= capacity {
+			continue
+		}
+		assigned[p.entryLock] = true
+		assignment[p.member] = append(assignment[p.member], &Selection{
+			Entry: p.entryLock.selectorEntry,
+			Slot:  p.entryLock.lockValue,
+		})
+	}
+
+	for member, selections := range assignment {
+		assignment[member] = s.sortSelections(selections)
+	}
+	return assignment
+}
+
+// rendezvousScore returns the weight of a member for a key.
+func rendezvousScore(member, key string) uint64 {
+	hash := sha256.Sum256([]byte(member + "\x00" + key))
+	return binary.BigEndian.Uint64(hash[:8])
+}
+
+// rendezvous returns up to n of the slots assigned to the current
+// actor by Assign over Config.Members. If n is below the actor's
+// share, every member is assigned at most n slots instead, so that
+// the slots are chosen by score rather than by the order of the
+// configuration. If no slot is assigned to the actor, e.g. because
+// there are more members than slots, the overflow policy applies.
+func (s *Selector) rendezvous(n int) ([]*Selection, error) {
+	actorID := s.actorID()
+	member := false
+	for _, m := range s.talcumConfig.Members {
+		if m == actorID {
+			member = true
+			break
+		}
+	}
+	if !member {
+		return nil, fmt.Errorf("actor %s is not a member", actorID)
+	}
+
+	members := s.talcumConfig.Members
+	slots := len(s.selectorConfig.entryLocks())
+	capacity := (slots + len(members) - 1) / len(members)
+	if n < capacity {
+		capacity = n
+	}
+	selections := s.assign(members, capacity)[actorID]
+	if s.talcumConfig.DebugMode {
+		log.Printf("Assigned %d slots to actor %s out of %d members", len(selections), actorID, len(s.talcumConfig.Members))
+	}
+	if len(selections) > n {
+		selections = selections[:n]
+	}
+	if len(selections) > 0 {
+		return selections, nil
+	}
+
+	selection, err := s.overflow()
+	if err != nil {
+		return nil, err
+	}
+	return []*Selection{selection}, nil
+}
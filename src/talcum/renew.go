@@ -0,0 +1,89 @@
+package talcum
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// lostLockError is returned by a renewal that found a lock gone, e.g.
+// because it expired and was taken over, so that renewing it again
+// can't help.
+type lostLockError struct {
+	key string
+}
+
+func (e *lostLockError) Error() string {
+	return fmt.Sprintf("lock was lost: %s", e.key)
+}
+
+// lossNotifier implements LossNotifier for the lockers that renew
+// their locks one by one.
+type lossNotifier struct {
+	lostMu sync.Mutex
+	lostCh chan<- string
+}
+
+// NotifyLost implements LossNotifier.
+func (n *lossNotifier) NotifyLost(lostCh chan<- string) {
+	n.lostMu.Lock()
+	defer n.lostMu.Unlock()
+	n.lostCh = lostCh
+}
+
+// notifyLost sends keys to the channel set with NotifyLost, if any,
+// unless doneCh is closed first.
+func (n *lossNotifier) notifyLost(keys []string, doneCh chan struct{}) {
+	n.lostMu.Lock()
+	lostCh := n.lostCh
+	n.lostMu.Unlock()
+	if lostCh == nil {
+		return
+	}
+
+	for _, key := range keys {
+		select {
+		case lostCh <- key:
+		case <-doneCh:
+			return
+		}
+	}
+}
+
+// renewPeriodically calls renew every ttl/3 until doneCh is closed,
+// after which it calls release, like the Consul API's RenewPeriodic.
+// renew returns the keys of the locks it found lost, which are passed
+// to notifier, if any, while the other locks keep being renewed.
+// Failed renewals are retried every second until ttl has passed since
+// the last successful renewal, when the last error is returned. A
+// lostLockError, e.g. for a lease that every lock is attached to, is
+// returned right away.
+func renewPeriodically(ttl time.Duration, renew func() ([]string, error), release func() error, notifier *lossNotifier, doneCh chan struct{}) error {
+	waitDur := ttl / 3
+	lastRenewTime := time.Now()
+	var lastErr error
+	for {
+		if time.Since(lastRenewTime) > ttl {
+			return lastErr
+		}
+		select {
+		case <-time.After(waitDur):
+			lost, err := renew()
+			if notifier != nil {
+				notifier.notifyLost(lost, doneCh)
+			}
+			if err != nil {
+				if _, ok := err.(*lostLockError); ok {
+					return err
+				}
+				waitDur = time.Second
+				lastErr = err
+				continue
+			}
+			waitDur = ttl / 3
+			lastRenewTime = time.Now()
+		case <-doneCh:
+			return release()
+		}
+	}
+}
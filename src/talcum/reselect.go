@@ -0,0 +1,118 @@
+package talcum
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Validate checks that a configuration can be used for selecting
+// roles.
+func (s SelectorConfig) Validate() error {
+	if len(s) == 0 {
+		return errors.New("config has no roles")
+	}
+
+	names := make(map[string]bool)
+	spares := 0
+	for _, entry := range s {
+		if entry.RoleName == "" {
+			return errors.New("config has a role without a name")
+		}
+		if names[entry.RoleName] {
+			return fmt.Errorf("role %s is defined more than once", entry.RoleName)
+		}
+		names[entry.RoleName] = true
+
+		if entry.Num < 0 {
+			return fmt.Errorf("role %s: num must not be negative", entry.RoleName)
+		}
+		if entry.Zones < 0 {
+			return fmt.Errorf("role %s: zones must not be negative", entry.RoleName)
+		}
+		if entry.OverflowWeight != nil && *entry.OverflowWeight < 0 {
+			return fmt.Errorf("role %s: overflow_weight must not be negative", entry.RoleName)
+		}
+		if _, err := ParseOverflowPolicy(string(entry.Overflow)); err != nil {
+			return fmt.Errorf("role %s: %v", entry.RoleName, err)
+		}
+		if entry.Spare {
+			spares++
+		}
+	}
+	if spares > 1 {
+		return errors.New("config has more than one spare role")
+	}
+	return nil
+}
+
+// Valid returns true if a selection still holds a role and slot that
+// exist in the configuration.
+func (s SelectorConfig) Valid(selection *Selection) bool {
+	entry := s.Entry(selection.Entry.RoleName)
+	if entry == nil {
+		return false
+	}
+	return selection.Random() || selection.Slot < entry.Num
+}
+
+// Reselect updates selections made with an earlier configuration to
+// the selector's configuration. Selections that are no longer valid,
+// because their role was removed or their slot is no longer below
+// the role's Num, are released and replaced by new selections. The
+// others are kept, with their entries taken from the current
+// configuration. Reselect returns true if any role, slot or role
+// definition changed.
+func (s *Selector) Reselect(selections []*Selection) ([]*Selection, bool, error) {
+	var next []*Selection
+	if len(s.talcumConfig.Members) > 0 {
+		var err error
+		next, err = s.rendezvous(len(selections))
+		if err != nil {
+			return selections, false, err
+		}
+	} else {
+		var kept []*Selection
+		for _, selection := range selections {
+			if s.selectorConfig.Valid(selection) {
+				kept = append(kept, &Selection{
+					Entry: s.selectorConfig.Entry(selection.Entry.RoleName),
+					Slot:  selection.Slot,
+					Claim: selection.Claim,
+				})
+				continue
+			}
+
+			if s.talcumConfig.DebugMode {
+				log.Printf("Role %s, slot %d no longer exists", selection.Entry.RoleName, selection.Slot)
+			}
+			if err := s.ReleaseClaim(selection); err != nil && err != ErrClaimLost {
+				return selections, false, err
+			}
+		}
+
+		var err error
+		next, err = s.selectMany(len(selections), kept)
+		if err != nil {
+			return next, true, err
+		}
+	}
+
+	return next, changed(selections, next), nil
+}
+
+// changed returns true if two lists of selections differ in any role,
+// slot or role definition.
+func changed(a, b []*Selection) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for i := range a {
+		if a[i].Entry.RoleName != b[i].Entry.RoleName ||
+			a[i].Entry.RoleDefinition != b[i].Entry.RoleDefinition ||
+			a[i].Slot != b[i].Slot {
+			return true
+		}
+	}
+	return false
+}
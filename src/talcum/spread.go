@@ -0,0 +1,39 @@
+package talcum
+
+// spread returns true if the slots of an entry are spread across
+// zones for the current actor. Actors without a zone are not
+// restricted.
+func (s *Selector) spread(entry *SelectorEntry) bool {
+	return entry.Zones > 0 && s.talcumConfig.Zone != ""
+}
+
+// zoneLimit returns the number of slots of an entry that actors in
+// one zone may hold, ceil(Num/Zones).
+func zoneLimit(entry *SelectorEntry) int {
+	return (entry.Num + entry.Zones - 1) / entry.Zones
+}
+
+// zoneCount returns the number of slots of an entry that are held by
+// actors in the current actor's zone, according to their claims. The
+// count is read before locking, so actors in the same zone selecting
+// at the same time may both exceed the limit by one.
+func (s *Selector) zoneCount(entry *SelectorEntry) (int, error) {
+	n := 0
+	for slot := 0; slot < entry.Num; slot++ {
+		value, err := s.locker.Get(s.lockKey(entry, slot))
+		if err != nil {
+			return 0, err
+		}
+		if value == nil {
+			continue
+		}
+		claim, err := ParseClaim(value)
+		if err != nil {
+			continue
+		}
+		if claim.Zone == s.talcumConfig.Zone {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,254 @@
+package talcum
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SQLLocker can lock keys using a SQL database as a backend. Each lock
+// is a row in the talcum_locks table, whose primary key ensures that
+// a key can only be locked once. The dialect is one of "postgres",
+// "mysql" or "sqlite3".
+type SQLLocker struct {
+	db      *sql.DB
+	dialect string
+	ttl     time.Duration
+
+	schemaOnce sync.Once
+	schemaErr  error
+
+	mu   sync.Mutex
+	held map[string][]byte
+
+	lossNotifier
+}
+
+// NewSQLLocker creates a new SQLLocker. If ttl is positive, locks
+// expire unless they are renewed with RenewLocks.
+func NewSQLLocker(db *sql.DB, dialect string, ttl time.Duration) (*SQLLocker, error) {
+	switch dialect {
+	case "postgres", "mysql", "sqlite3":
+	default:
+		return nil, fmt.Errorf("unsupported SQL dialect: %s", dialect)
+	}
+	return &SQLLocker{
+		db:      db,
+		dialect: dialect,
+		ttl:     ttl,
+		held:    make(map[string][]byte),
+	}, nil
+}
+
+// query rewrites the "?" placeholders of q for the locker's dialect.
+func (s *SQLLocker) query(q string) string {
+	if s.dialect != "postgres" {
+		return q
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range q {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// CreateSchema creates the talcum_locks table if it does not
+// exist. It is called by Lock, so calling it is only necessary to
+// create the table ahead of time.
+func (s *SQLLocker) CreateSchema() error {
+	s.schemaOnce.Do(func() {
+		// Expiry times are stored as Unix milliseconds so that
+		// they compare the same way in every database.
+		_, s.schemaErr = s.db.Exec(`CREATE TABLE IF NOT EXISTS talcum_locks (
+	lock_key VARCHAR(255) NOT NULL PRIMARY KEY,
+	value TEXT NOT NULL,
+	expires_at BIGINT NULL
+)`)
+	})
+	return s.schemaErr
+}
+
+func (s *SQLLocker) expiresAt(now time.Time) interface{} {
+	if s.ttl <= 0 {
+		return nil
+	}
+	return now.Add(s.ttl).UnixNano() / int64(time.Millisecond)
+}
+
+// Lock tries to lock a key, storing value in it, return true if the
+// lock operation was successful.
+func (s *SQLLocker) Lock(key string, value []byte) (bool, error) {
+	if err := s.CreateSchema(); err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	_, err := s.db.Exec(s.query(
+		"DELETE FROM talcum_locks WHERE lock_key = ? AND expires_at IS NOT NULL AND expires_at < ?"),
+		key, now.UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+
+	insert := "INSERT INTO talcum_locks (lock_key, value, expires_at) VALUES (?, ?, ?)"
+	switch s.dialect {
+	case "mysql":
+		insert = strings.Replace(insert, "INSERT", "INSERT IGNORE", 1)
+	default:
+		insert += " ON CONFLICT (lock_key) DO NOTHING"
+	}
+	res, err := s.db.Exec(s.query(insert), key, string(value), s.expiresAt(now))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	s.held[key] = value
+	s.mu.Unlock()
+	return true, nil
+}
+
+// Get returns the value of a key or nil if it is not locked.
+func (s *SQLLocker) Get(key string) ([]byte, error) {
+	if err := s.CreateSchema(); err != nil {
+		return nil, err
+	}
+
+	var value string
+	err := s.db.QueryRow(s.query(
+		"SELECT value FROM talcum_locks WHERE lock_key = ? AND (expires_at IS NULL OR expires_at >= ?)"),
+		key, time.Now().UnixNano()/int64(time.Millisecond)).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+// Unlock releases a key by deleting its row.
+func (s *SQLLocker) Unlock(key string) error {
+	if err := s.CreateSchema(); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(s.query("DELETE FROM talcum_locks WHERE lock_key = ?"), key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	delete(s.held, key)
+	s.mu.Unlock()
+	return nil
+}
+
+// UnlockIf implements CompareUnlocker by deleting the key's row only
+// if it still has the value that was read.
+func (s *SQLLocker) UnlockIf(key string, held func(value []byte) bool) (bool, error) {
+	value, err := s.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if value == nil || !held(value) {
+		return false, nil
+	}
+	return s.unlock(key, value)
+}
+
+// unlock deletes a key's row if it still has value.
+func (s *SQLLocker) unlock(key string, value []byte) (bool, error) {
+	res, err := s.db.Exec(s.query("DELETE FROM talcum_locks WHERE lock_key = ? AND value = ?"), key, string(value))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	delete(s.held, key)
+	s.mu.Unlock()
+	return n > 0, nil
+}
+
+// Renew implements Renewer using RenewLocks.
+func (s *SQLLocker) Renew(doneCh chan struct{}) error {
+	return s.RenewLocks(doneCh)
+}
+
+// RenewLocks periodically extends the expiry of the locks set by the
+// locker until doneCh is closed, after which the locks are
+// deleted. It returns immediately if locks do not expire.
+func (s *SQLLocker) RenewLocks(doneCh chan struct{}) error {
+	if s.ttl <= 0 {
+		return nil
+	}
+
+	return renewPeriodically(s.ttl, s.renew, s.release, &s.lossNotifier, doneCh)
+}
+
+// release deletes the locks set by the locker that still hold the
+// locker's values.
+func (s *SQLLocker) release() error {
+	s.mu.Lock()
+	held := make(map[string][]byte, len(s.held))
+	for key, value := range s.held {
+		held[key] = value
+	}
+	s.mu.Unlock()
+
+	for key, value := range held {
+		if _, err := s.unlock(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forget implements Forgetter.
+func (s *SQLLocker) Forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.held, key)
+}
+
+func (s *SQLLocker) renew() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var lost []string
+	for key, value := range s.held {
+		res, err := s.db.Exec(s.query(
+			"UPDATE talcum_locks SET expires_at = ? WHERE lock_key = ? AND value = ?"),
+			s.expiresAt(time.Now()), key, string(value))
+		if err != nil {
+			return lost, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return lost, err
+		}
+		if n == 0 {
+			delete(s.held, key)
+			lost = append(lost, key)
+		}
+	}
+	return lost, nil
+}
@@ -0,0 +1,163 @@
+package talcum_test
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/talcum/src/talcum"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every connection to ":memory:" opens a new database.
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func TestSQLLocker(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	locker, err := talcum.NewSQLLocker(db, "sqlite3", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked, err := locker.Lock("app/1/abc/0", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected key to be locked")
+	}
+
+	value, err := locker.Get("app/1/abc/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "1" {
+		t.Fatalf("unexpected value: %s", value)
+	}
+
+	locked, err = locker.Lock("app/1/abc/0", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Fatal("expected locked key to stay locked")
+	}
+
+	if err := locker.Unlock("app/1/abc/0"); err != nil {
+		t.Fatal(err)
+	}
+	locked, err = locker.Lock("app/1/abc/0", []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected unlocked key to be lockable")
+	}
+}
+
+func TestSQLLockerExpiry(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	locker, err := talcum.NewSQLLocker(db, "sqlite3", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked, err := locker.Lock("app/1/abc/0", []byte("1"))
+	if err != nil || !locked {
+		t.Fatalf("expected key to be locked: %v", err)
+	}
+	locked, err = locker.Lock("app/1/abc/0", []byte("2"))
+	if err != nil || locked {
+		t.Fatalf("expected key to stay locked: %v", err)
+	}
+
+	expired := time.Now().Add(-time.Second).UnixNano() / int64(time.Millisecond)
+	if _, err := db.Exec("UPDATE talcum_locks SET expires_at = ?", expired); err != nil {
+		t.Fatal(err)
+	}
+	locked, err = locker.Lock("app/1/abc/0", []byte("2"))
+	if err != nil || !locked {
+		t.Fatalf("expected expired key to be lockable: %v", err)
+	}
+
+	doneCh := make(chan struct{})
+	close(doneCh)
+	if err := locker.RenewLocks(doneCh); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM talcum_locks").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("expected held keys to be deleted, found: %d", n)
+	}
+}
+
+func TestSQLLockerLeavesRowsTakenOver(t *testing.T) {
+	db := newTestDB(t)
+	defer db.Close()
+
+	a, err := talcum.NewSQLLocker(db, "sqlite3", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := talcum.NewSQLLocker(db, "sqlite3", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := a.Lock("app/1/abc/0", []byte("a")); err != nil || !locked {
+		t.Fatalf("expected key to be locked: %v", err)
+	}
+
+	// The lock expires and is taken over by another actor.
+	expired := time.Now().Add(-time.Second).UnixNano() / int64(time.Millisecond)
+	if _, err := db.Exec("UPDATE talcum_locks SET expires_at = ?", expired); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := b.Lock("app/1/abc/0", []byte("b")); err != nil || !locked {
+		t.Fatalf("expected expired key to be lockable: %v", err)
+	}
+
+	unlocked, err := a.UnlockIf("app/1/abc/0", func(value []byte) bool { return string(value) == "a" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlocked {
+		t.Fatal("expected a row taken over to stay locked")
+	}
+
+	doneCh := make(chan struct{})
+	close(doneCh)
+	if err := a.RenewLocks(doneCh); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := b.Get("app/1/abc/0"); err != nil || string(value) != "b" {
+		t.Fatalf("expected the other actor's lock to be left alone, got: %s, %v", value, err)
+	}
+
+	unlocked, err = b.UnlockIf("app/1/abc/0", func(value []byte) bool { return string(value) == "b" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !unlocked {
+		t.Fatal("expected the row to be deleted")
+	}
+}
+
+func TestSQLLockerUnsupportedDialect(t *testing.T) {
+	if _, err := talcum.NewSQLLocker(nil, "oracle", 0); err == nil {
+		t.Fatal("expected an error for an unsupported dialect")
+	}
+}
@@ -2,10 +2,14 @@ package talcum
 
 import (
 	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -14,6 +18,37 @@ import (
 type Config struct {
 	ApplicationName string
 	SelectionID     string
+	// ActorID identifies the current actor in claims. It defaults
+	// to DefaultActorID().
+	ActorID string
+	// Sticky makes the actor re-adopt a slot it already holds
+	// before selecting a new one. It requires an ActorID that
+	// stays the same across restarts.
+	Sticky bool
+	// Prioritize makes the actor try to lock the slots of entries
+	// with a higher Priority before the slots of entries with a
+	// lower Priority.
+	Prioritize bool
+	// Zone is the availability zone of the actor. It is recorded in
+	// claims and used to spread the slots of entries that set Zones.
+	Zone string
+	// Labels describe the actor, e.g. {"disk": "ssd"}. Only entries
+	// whose requirements are all met by the labels are selected.
+	Labels map[string]string
+	// Members are the IDs of every actor. If set, slots are assigned
+	// to members by rendezvous hashing instead of being locked, and
+	// the actor takes the slots assigned to its ActorID.
+	Members []string
+	// DistinctRoles makes SelectMany lock the slots of distinct
+	// entries only.
+	DistinctRoles bool
+	// Overflow is the policy applied when every slot is taken, for
+	// entries that do not set their own. It defaults to
+	// OverflowRandom.
+	Overflow OverflowPolicy
+	// OverflowTimeout is how long OverflowBlock waits for a slot to
+	// free up. Zero waits forever.
+	OverflowTimeout time.Duration
 	LockDelay       time.Duration
 	DebugMode       bool
 }
@@ -24,11 +59,68 @@ type SelectorEntry struct {
 	RoleName       string `json:"role_name"`
 	RoleDefinition string `json:"role_definition"`
 	Num            int    `json:"num"`
+	// Priority orders the entries when selecting with
+	// Config.Prioritize: the slots of entries with a higher priority
+	// are filled first.
+	Priority int `json:"priority,omitempty"`
+	// Overflow overrides Config.Overflow for actors that overflow
+	// into the entry.
+	Overflow OverflowPolicy `json:"overflow,omitempty"`
+	// Spare marks the entry taken by actors whose overflow policy is
+	// OverflowSpare.
+	Spare bool `json:"spare,omitempty"`
+	// Requires are labels the actor must have for the entry to be
+	// selected.
+	Requires map[string]string `json:"requires,omitempty"`
+	// Zones makes actors in the same zone hold at most
+	// ceil(Num/Zones) of the entry's slots.
+	Zones int `json:"zones,omitempty"`
+	// OverflowWeight replaces Num as the weight of the entry when
+	// choosing an entry randomly. A weight of 0 excludes it.
+	OverflowWeight *int `json:"overflow_weight,omitempty"`
+}
+
+// weight returns the weight of the entry when choosing an entry
+// randomly.
+func (e *SelectorEntry) weight() int {
+	if e.OverflowWeight != nil {
+		return *e.OverflowWeight
+	}
+	return e.Num
 }
 
 // SelectorConfig all selectable entries.
 type SelectorConfig []*SelectorEntry
 
+// Entry returns the entry with the given role name or nil if there is
+// no such entry.
+func (s SelectorConfig) Entry(roleName string) *SelectorEntry {
+	for _, entry := range s {
+		if entry.RoleName == roleName {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Selection is an entry returned by a Selector along with the slot
+// that was locked for it.
+type Selection struct {
+	Entry *SelectorEntry
+	// Slot is the number of the locked slot. It is -1 if the entry
+	// was chosen randomly.
+	Slot int
+	// Claim is the claim stored in the slot's lock. It is nil if
+	// the entry was chosen randomly.
+	Claim *Claim
+}
+
+// Random returns true if the entry was chosen randomly because no
+// slot could be locked.
+func (s *Selection) Random() bool {
+	return s.Slot < 0
+}
+
 type entryLock struct {
 	selectorEntry *SelectorEntry
 	lockValue     int
@@ -49,6 +141,9 @@ func (s SelectorConfig) entryLocks() []*entryLock {
 
 func shuffleEntryLocks(locks []*entryLock) []*entryLock {
 	var shuffledLocks []*entryLock
+	if len(locks) == 0 {
+		return shuffledLocks
+	}
 
 	// This algorithm could potentially not terminate, but the
 	// average running time is O(len(locks)).
@@ -70,9 +165,65 @@ func shuffleEntryLocks(locks []*entryLock) []*entryLock {
 	return shuffledLocks
 }
 
-// Locker can set a lock for an entry.
+// prioritizeEntryLocks shuffles locks and orders them by descending
+// priority, so that locks are only shuffled within a priority tier.
+func prioritizeEntryLocks(locks []*entryLock) []*entryLock {
+	shuffledLocks := shuffleEntryLocks(locks)
+	sort.SliceStable(shuffledLocks, func(i, j int) bool {
+		return shuffledLocks[i].selectorEntry.Priority > shuffledLocks[j].selectorEntry.Priority
+	})
+	return shuffledLocks
+}
+
+// Locker can set, read and release a lock for an entry. The value of
+// a lock is a JSON encoded Claim. Get returns nil if the key is not
+// locked.
 type Locker interface {
-	Lock(key string) (bool, error)
+	Lock(key string, value []byte) (bool, error)
+	Unlock(key string) error
+	Get(key string) ([]byte, error)
+}
+
+// KeyLister is implemented by lockers that can list every locked key
+// under a prefix in a single round trip. Selector uses it to skip the
+// slots that are already taken instead of trying to lock each of
+// them.
+type KeyLister interface {
+	Keys(prefix string) ([]string, error)
+}
+
+// CompareUnlocker is implemented by lockers that can release a lock
+// only if its value satisfies held, without the lock changing in
+// between. UnlockIf returns false, leaving the lock alone, if the key
+// is not locked or held returns false.
+type CompareUnlocker interface {
+	UnlockIf(key string, held func(value []byte) bool) (bool, error)
+}
+
+// Renewer is implemented by lockers whose locks expire unless they are
+// kept alive, or that hold resources, like Consul sessions, that must
+// be cleaned up. Renew keeps the locker's locks alive until doneCh is
+// closed, after which they are released. It returns an error if the
+// locks could not be kept alive, and returns immediately if there is
+// nothing to keep alive or release.
+type Renewer interface {
+	Renew(doneCh chan struct{}) error
+}
+
+// LossNotifier is implemented by Renewers that keep renewing the locks
+// they still hold when others are lost, e.g. because they expired and
+// were taken over. NotifyLost makes Renew send the key of every lost
+// lock to lostCh, unless doneCh is closed first.
+type LossNotifier interface {
+	NotifyLost(lostCh chan<- string)
+}
+
+// Forgetter is implemented by Renewers that keep the locks they set
+// alive. Forget stops keeping the lock of key alive without releasing
+// it, for records that other actors replace, which would otherwise be
+// reported as lost.
+type Forgetter interface {
+	Forget(key string)
 }
 
 // Selector can select one of the entries it is configured to
@@ -82,6 +233,9 @@ type Selector struct {
 	talcumConfig   *Config
 	selectorConfig SelectorConfig
 	locker         Locker
+
+	cancelOnce sync.Once
+	cancelCh   chan struct{}
 }
 
 // NewSelector creates a new selector.
@@ -90,6 +244,42 @@ func NewSelector(config *Config, selectorConfig SelectorConfig, locker Locker) *
 		talcumConfig:   config,
 		selectorConfig: selectorConfig,
 		locker:         locker,
+		cancelCh:       make(chan struct{}),
+	}
+}
+
+// ErrCanceled is returned by selections that were canceled with
+// Cancel.
+var ErrCanceled = errors.New("selection canceled")
+
+// Cancel makes selections in progress, e.g. ones waiting for a slot
+// with OverflowBlock, return ErrCanceled along with the slots locked
+// so far, so that they can be released. Selections made after Cancel
+// return ErrCanceled right away.
+func (s *Selector) Cancel() {
+	s.cancelOnce.Do(func() {
+		close(s.cancelCh)
+	})
+}
+
+// canceled returns ErrCanceled if Cancel was called.
+func (s *Selector) canceled() error {
+	select {
+	case <-s.cancelCh:
+		return ErrCanceled
+	default:
+		return nil
+	}
+}
+
+// sleep waits for d, returning ErrCanceled if Cancel is called in the
+// meantime.
+func (s *Selector) sleep(d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-s.cancelCh:
+		return ErrCanceled
 	}
 }
 
@@ -98,38 +288,283 @@ func (s *Selector) lockKey(entry *SelectorEntry, num int) string {
 	hasher.Write([]byte(entry.RoleName))
 	hasher.Write([]byte(strconv.Itoa(num)))
 
-	return fmt.Sprintf("%s/%s/%x/%v",
+	return fmt.Sprintf("%s%x/%v", s.keyPrefix(), hasher.Sum(nil)[:10], num)
+}
+
+// keyPrefix returns the prefix shared by every key of the current
+// selection process.
+func (s *Selector) keyPrefix() string {
+	return fmt.Sprintf("%s/%s/",
 		s.talcumConfig.ApplicationName,
-		s.talcumConfig.SelectionID, hasher.Sum(nil)[:10], num)
+		s.talcumConfig.SelectionID)
+}
+
+// Eligible returns true if the actor's labels meet every requirement
+// of an entry.
+func (s *Selector) Eligible(entry *SelectorEntry) bool {
+	for key, value := range entry.Requires {
+		if label, ok := s.talcumConfig.Labels[key]; !ok || label != value {
+			return false
+		}
+	}
+	return true
 }
 
-// SelectRandom returns a random entry, weighing each entry using its
-// expected number of occurrences as a weight.
+// entryLocks returns the slots of the entries the actor is eligible
+// for.
+func (s *Selector) entryLocks() []*entryLock {
+	var locks []*entryLock
+	for _, entryLock := range s.selectorConfig.entryLocks() {
+		if s.Eligible(entryLock.selectorEntry) {
+			locks = append(locks, entryLock)
+		}
+	}
+	return locks
+}
+
+// SelectRandom returns a random entry the actor is eligible for,
+// weighing each entry using its OverflowWeight, or else its expected
+// number of occurrences, as a weight. It returns nil if no such entry
+// has a positive weight.
 func (s *Selector) SelectRandom() *SelectorEntry {
-	max := len(s.selectorConfig.entryLocks())
-	r := rand.Intn(max)
-	return s.selectorConfig.entryLocks()[r].selectorEntry
+	return s.selectRandom(nil)
+}
+
+// selectRandom is like SelectRandom, but only considers the entries
+// for which include returns true, if include is not nil.
+func (s *Selector) selectRandom(include func(*SelectorEntry) bool) *SelectorEntry {
+	drawable := func(entry *SelectorEntry) bool {
+		return s.Eligible(entry) && entry.weight() > 0 && (include == nil || include(entry))
+	}
+
+	total := 0
+	for _, entry := range s.selectorConfig {
+		if drawable(entry) {
+			total += entry.weight()
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	r := rand.Intn(total)
+	for _, entry := range s.selectorConfig {
+		if !drawable(entry) {
+			continue
+		}
+		if r < entry.weight() {
+			return entry
+		}
+		r -= entry.weight()
+	}
+	return nil
 }
 
 // Select locks an entry and returns it. Select attempts to lock all
 // entries up to the configured number. If all entries have been
-// locked, a random one is returned.
+// locked, the overflow policy decides which entry is returned, if
+// any.
 func (s *Selector) Select() (*SelectorEntry, error) {
-	entryLocks := shuffleEntryLocks(s.selectorConfig.entryLocks())
+	selection, err := s.SelectSlot()
+	if err != nil {
+		return nil, err
+	}
+	return selection.Entry, nil
+}
+
+// SelectSlot is like Select, but also returns the slot that was
+// locked so that it can be released later.
+func (s *Selector) SelectSlot() (*Selection, error) {
+	if len(s.talcumConfig.Members) > 0 {
+		selections, err := s.rendezvous(1)
+		if err != nil {
+			return nil, err
+		}
+		return selections[0], nil
+	}
+
+	selection, err := s.claim(nil)
+	if err != nil || selection != nil {
+		return selection, err
+	}
+
+	if s.talcumConfig.DebugMode {
+		log.Printf("All keys are locked, applying overflow policy")
+	}
+	return s.overflow()
+}
+
+// SelectMany is like Select, but locks up to n slots, e.g. so that
+// fewer actors than roles can cover every role. The entries are
+// returned in the order of the configuration.
+func (s *Selector) SelectMany(n int) ([]*SelectorEntry, error) {
+	selections, err := s.SelectManySlots(n)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*SelectorEntry, len(selections))
+	for i, selection := range selections {
+		entries[i] = selection.Entry
+	}
+	return entries, nil
+}
+
+// SelectManySlots is like SelectSlot, but locks up to n slots, of
+// distinct entries only if Config.DistinctRoles is set. The overflow
+// policy only applies if no slot could be locked. The selections are
+// sorted by the order of their entries in the configuration and by
+// slot. If an error occurs, the slots locked so far are returned
+// along with it so that they can be released.
+func (s *Selector) SelectManySlots(n int) ([]*Selection, error) {
+	if len(s.talcumConfig.Members) > 0 {
+		return s.rendezvous(n)
+	}
+	return s.selectMany(n, nil)
+}
 
+// selectMany locks slots until n slots, including the slots of kept,
+// are held. The overflow policy only applies if no slot is held.
+func (s *Selector) selectMany(n int, kept []*Selection) ([]*Selection, error) {
+	var selections []*Selection
+	held := make(map[string]bool)
+	roles := make(map[string]bool)
+	skip := func(entryLock *entryLock) bool {
+		if held[s.lockKey(entryLock.selectorEntry, entryLock.lockValue)] {
+			return true
+		}
+		return s.talcumConfig.DistinctRoles && roles[entryLock.selectorEntry.RoleName]
+	}
+	for _, selection := range kept {
+		selections = append(selections, selection)
+		if !selection.Random() {
+			held[s.lockKey(selection.Entry, selection.Slot)] = true
+			roles[selection.Entry.RoleName] = true
+		}
+	}
+
+	for len(selections) < n {
+		selection, err := s.claim(skip)
+		if err != nil {
+			return s.sortSelections(selections), err
+		}
+		if selection == nil {
+			break
+		}
+		selections = append(selections, selection)
+		held[s.lockKey(selection.Entry, selection.Slot)] = true
+		roles[selection.Entry.RoleName] = true
+	}
+
+	if len(selections) == 0 {
+		if s.talcumConfig.DebugMode {
+			log.Printf("All keys are locked, applying overflow policy")
+		}
+		selection, err := s.overflow()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, selection)
+	}
+	return s.sortSelections(selections), nil
+}
+
+// sortSelections sorts selections by the order of their entries in
+// the configuration and by slot.
+func (s *Selector) sortSelections(selections []*Selection) []*Selection {
+	index := make(map[*SelectorEntry]int)
+	for i, entry := range s.selectorConfig {
+		index[entry] = i
+	}
+	sort.SliceStable(selections, func(i, j int) bool {
+		a, b := selections[i], selections[j]
+		if index[a.Entry] != index[b.Entry] {
+			return index[a.Entry] < index[b.Entry]
+		}
+		return a.Slot < b.Slot
+	})
+	return selections
+}
+
+// claim locks a slot, re-adopting one first if Config.Sticky is set.
+// Slots for which skip returns true are left alone. It returns nil if
+// every other slot is taken.
+func (s *Selector) claim(skip func(*entryLock) bool) (*Selection, error) {
+	if s.talcumConfig.Sticky {
+		selection, err := s.readopt(skip)
+		if err != nil || selection != nil {
+			return selection, err
+		}
+	}
+	return s.lockFree(skip)
+}
+
+// lockFree tries to lock each slot once, except those for which skip
+// returns true, returning nil if every slot is taken. If the locker
+// is a KeyLister, the taken slots are listed first and skipped, so
+// that a free slot is usually locked in two round trips.
+func (s *Selector) lockFree(skip func(*entryLock) bool) (*Selection, error) {
+	var entryLocks []*entryLock
+	if s.talcumConfig.Prioritize {
+		entryLocks = prioritizeEntryLocks(s.entryLocks())
+	} else {
+		entryLocks = shuffleEntryLocks(s.entryLocks())
+	}
+
+	roundTrips := 0
+	taken := make(map[string]bool)
+	if lister, ok := s.locker.(KeyLister); ok {
+		keys, err := lister.Keys(s.keyPrefix())
+		roundTrips++
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			taken[key] = true
+		}
+	}
+
+	zoneFull := make(map[*SelectorEntry]bool)
 	for _, entryLock := range entryLocks {
+		if err := s.canceled(); err != nil {
+			return nil, err
+		}
 		key := s.lockKey(entryLock.selectorEntry, entryLock.lockValue)
+		if taken[key] || (skip != nil && skip(entryLock)) {
+			continue
+		}
+
+		entry := entryLock.selectorEntry
+		full, ok := zoneFull[entry]
+		if !ok && s.spread(entry) {
+			n, err := s.zoneCount(entry)
+			roundTrips += entry.Num
+			if err != nil {
+				return nil, err
+			}
+			full = n >= zoneLimit(entry)
+			if full && s.talcumConfig.DebugMode {
+				log.Printf("Zone %s holds %d slots of role %s, skipping it", s.talcumConfig.Zone, n, entry.RoleName)
+			}
+		}
+		zoneFull[entry] = full
+		if full {
+			continue
+		}
 
 		if s.talcumConfig.DebugMode {
 			log.Printf("Attempting to lock key: %s", key)
 		}
 
-		locked, err := s.locker.Lock(key)
+		selection, err := s.lock(entryLock)
+		roundTrips++
 		if err != nil {
 			return nil, err
 		}
-		if locked {
-			return entryLock.selectorEntry, nil
+		if selection != nil {
+			if s.talcumConfig.DebugMode {
+				log.Printf("Locked key %s in %d round trips", key, roundTrips)
+			}
+			return selection, nil
 		}
 
 		if s.talcumConfig.DebugMode {
@@ -143,14 +578,168 @@ func (s *Selector) Select() (*SelectorEntry, error) {
 				log.Printf("Sleeping before attempting to select new key")
 			}
 
-			time.Sleep(s.talcumConfig.LockDelay)
+			if err := s.sleep(s.talcumConfig.LockDelay); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if s.talcumConfig.DebugMode {
+		log.Printf("Found every key locked in %d round trips", roundTrips)
+	}
+	return nil, nil
+}
+
+// lock tries to lock the slot of an entry, returning nil if the slot
+// is already locked.
+func (s *Selector) lock(entryLock *entryLock) (*Selection, error) {
+	key := s.lockKey(entryLock.selectorEntry, entryLock.lockValue)
+	claim := s.newClaim(entryLock.selectorEntry, entryLock.lockValue)
+	value, err := json.Marshal(claim)
+	if err != nil {
+		return nil, err
+	}
+
+	locked, err := s.locker.Lock(key, value)
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		return nil, nil
+	}
+	return &Selection{
+		Entry: entryLock.selectorEntry,
+		Slot:  entryLock.lockValue,
+		Claim: claim,
+	}, nil
+}
+
+// readopt looks for a slot that is held by the current actor, e.g.
+// before it was restarted, and claims it again. Slots for which skip
+// returns true are left alone. It returns nil if no such slot exists.
+func (s *Selector) readopt(skip func(*entryLock) bool) (*Selection, error) {
+	actorID := s.actorID()
+
+	for _, entryLock := range s.entryLocks() {
+		if skip != nil && skip(entryLock) {
+			continue
+		}
+		key := s.lockKey(entryLock.selectorEntry, entryLock.lockValue)
+		value, err := s.locker.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+		claim, err := ParseClaim(value)
+		if err != nil || claim.ActorID != actorID {
+			continue
+		}
+
+		if s.talcumConfig.DebugMode {
+			log.Printf("Re-adopting key: %s", key)
+		}
+
+		// The lock is set again so that it is held with a fresh
+		// claim, e.g. by the current Consul session. If another
+		// actor claims the slot in between, a new slot is
+		// selected.
+		if _, err := s.unlockClaim(key, claim); err != nil {
+			return nil, err
+		}
+		selection, err := s.lock(entryLock)
+		if err != nil || selection != nil {
+			return selection, err
+		}
+	}
+	return nil, nil
+}
+
+// Release unlocks a slot of an entry so that it can be selected
+// again.
+func (s *Selector) Release(entry *SelectorEntry, slot int) error {
+	if slot < 0 || slot >= entry.Num {
+		return fmt.Errorf("slot %d of role %s does not exist", slot, entry.RoleName)
+	}
+
+	key := s.lockKey(entry, slot)
+	if s.talcumConfig.DebugMode {
+		log.Printf("Releasing key: %s", key)
+	}
+	return s.locker.Unlock(key)
+}
+
+// Held returns the selections of every slot whose claim was made by
+// the actor with the given ID, e.g. so that a shutdown hook can
+// release the slots of an actor without knowing which ones it
+// selected.
+func (s *Selector) Held(actorID string) ([]*Selection, error) {
+	var selections []*Selection
+	for _, entryLock := range s.selectorConfig.entryLocks() {
+		value, err := s.locker.Get(s.lockKey(entryLock.selectorEntry, entryLock.lockValue))
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			continue
+		}
+		claim, err := ParseClaim(value)
+		if err != nil || claim.ActorID != actorID {
+			continue
 		}
+		selections = append(selections, &Selection{
+			Entry: entryLock.selectorEntry,
+			Slot:  entryLock.lockValue,
+			Claim: claim,
+		})
+	}
+	return selections, nil
+}
+
+// ReleaseClaim releases the slot of a selection if it is still locked
+// with the selection's claim. If another claim holds the slot, e.g.
+// because the selection's lock expired and another actor claimed the
+// slot, the lock is left alone and ErrClaimLost is returned.
+// Selections without a claim hold no lock and are ignored.
+func (s *Selector) ReleaseClaim(selection *Selection) error {
+	if selection.Claim == nil {
+		return nil
 	}
 
+	key := s.lockKey(selection.Entry, selection.Slot)
 	if s.talcumConfig.DebugMode {
-		log.Printf("All keys are locked, selecting random key")
+		log.Printf("Releasing key: %s", key)
 	}
+	released, err := s.unlockClaim(key, selection.Claim)
+	if err != nil {
+		return err
+	}
+	if !released {
+		return ErrClaimLost
+	}
+	return nil
+}
 
-	// If we couldn't claim anything, choose an entry randomly.
-	return s.SelectRandom(), nil
+// unlockClaim deletes a lock if it holds claim, returning false if it
+// does not. If the locker is not a CompareUnlocker, the claim is read
+// before the lock is deleted, so that only a claim made in between is
+// deleted by mistake.
+func (s *Selector) unlockClaim(key string, claim *Claim) (bool, error) {
+	held := func(value []byte) bool {
+		stored, err := ParseClaim(value)
+		return err == nil && sameClaim(stored, claim)
+	}
+	if unlocker, ok := s.locker.(CompareUnlocker); ok {
+		return unlocker.UnlockIf(key, held)
+	}
+
+	value, err := s.locker.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if value == nil || !held(value) {
+		return false, nil
+	}
+	return true, s.locker.Unlock(key)
 }
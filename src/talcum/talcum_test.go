@@ -2,29 +2,14 @@ package talcum_test
 
 import (
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dollarshaveclub/talcum/src/talcum"
+	"github.com/dollarshaveclub/talcum/src/talcumtest"
 )
 
-type mockLocker struct {
-	lockedKeys map[string]bool
-}
-
-func newMockLocker() *mockLocker {
-	return &mockLocker{
-		lockedKeys: make(map[string]bool),
-	}
-}
-
-func (m *mockLocker) Lock(key string) (bool, error) {
-	if _, ok := m.lockedKeys[key]; ok {
-		return false, nil
-	}
-	m.lockedKeys[key] = true
-	return true, nil
-}
-
 func TestSelectSmoke(t *testing.T) {
 	talcumConfig := &talcum.Config{
 		ApplicationName: "test-app",
@@ -40,7 +25,7 @@ func TestSelectSmoke(t *testing.T) {
 			Num:      2,
 		},
 	}
-	locker := newMockLocker()
+	locker := talcumtest.NewLocker()
 
 	selector := talcum.NewSelector(talcumConfig, selectorConfig, locker)
 
@@ -67,7 +52,7 @@ func TestSelectChoosesAllEntries(t *testing.T) {
 	}
 
 	for j := 0; j < 10; j++ {
-		locker := newMockLocker()
+		locker := talcumtest.NewLocker()
 		selector := talcum.NewSelector(talcumConfig, selectorConfig, locker)
 		seen := make(map[string]int)
 
@@ -103,7 +88,7 @@ func TestSelectChoosesAllEntriesAtLeastMin(t *testing.T) {
 	}
 
 	for j := 0; j < 10; j++ {
-		locker := newMockLocker()
+		locker := talcumtest.NewLocker()
 		selector := talcum.NewSelector(talcumConfig, selectorConfig, locker)
 		seen := make(map[string]int)
 
@@ -123,3 +108,1025 @@ func TestSelectChoosesAllEntriesAtLeastMin(t *testing.T) {
 		}
 	}
 }
+
+func TestSelectorRelease(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+	}
+	selectorConfig := []*talcum.SelectorEntry{
+		{
+			RoleName: "1",
+			Num:      1,
+		},
+	}
+	locker := talcumtest.NewLocker()
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, locker)
+
+	selection, err := selector.SelectSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selection.Random() || selection.Slot != 0 {
+		t.Fatalf("expected slot 0 to be locked, got: %d", selection.Slot)
+	}
+
+	selection, err = selector.SelectSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !selection.Random() {
+		t.Fatalf("expected a random selection, got slot: %d", selection.Slot)
+	}
+
+	if err := selector.Release(selectorConfig[0], 0); err != nil {
+		t.Fatal(err)
+	}
+	if keys := locker.Keys(); len(keys) != 0 {
+		t.Fatalf("expected no locked keys, got: %d", len(keys))
+	}
+	if err := selector.Release(selectorConfig[0], 1); err == nil {
+		t.Fatal("expected an error releasing a nonexistent slot")
+	}
+}
+
+func TestSelectStoresClaim(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+		ActorID:         "actor-1",
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      1,
+		},
+	}
+	locker := talcumtest.NewLocker()
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, locker)
+
+	selection, err := selector.SelectSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range locker.Keys() {
+		value, _ := locker.Value(key)
+		claim, err := talcum.ParseClaim(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claim.ActorID != "actor-1" || claim.RoleName != "1" || claim.Slot != 0 {
+			t.Fatalf("unexpected claim: %+v", claim)
+		}
+		if claim.ConfigHash != selectorConfig.Hash() {
+			t.Fatalf("expected config hash: %s, got: %s", selectorConfig.Hash(), claim.ConfigHash)
+		}
+		if claim.PID == 0 || claim.ClaimedAt.IsZero() {
+			t.Fatalf("expected PID and claim time to be set: %+v", claim)
+		}
+		if *claim != *selection.Claim {
+			t.Fatalf("expected stored claim to match selection: %+v", selection.Claim)
+		}
+	}
+}
+
+func TestSelectStickyReadoptsSlot(t *testing.T) {
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      5,
+		},
+		{
+			RoleName: "2",
+			Num:      5,
+		},
+	}
+	locker := talcumtest.NewLocker()
+
+	newConfig := func(actorID string) *talcum.Config {
+		return &talcum.Config{
+			ApplicationName: "test-app",
+			SelectionID:     "test-id",
+			ActorID:         actorID,
+			Sticky:          true,
+		}
+	}
+
+	first, err := talcum.NewSelector(newConfig("actor-1"), selectorConfig, locker).SelectSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := talcum.NewSelector(newConfig("actor-2"), selectorConfig, locker).SelectSlot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarting the actor must not claim a second slot.
+	for i := 0; i < 10; i++ {
+		selection, err := talcum.NewSelector(newConfig("actor-1"), selectorConfig, locker).SelectSlot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selection.Entry != first.Entry || selection.Slot != first.Slot {
+			t.Fatalf("expected slot %s/%d to be re-adopted, got: %s/%d",
+				first.Entry.RoleName, first.Slot, selection.Entry.RoleName, selection.Slot)
+		}
+	}
+	if keys := locker.Keys(); len(keys) != 2 {
+		t.Fatalf("expected 2 locked keys, got: %d", len(keys))
+	}
+}
+
+func TestSelectPrioritizeFillsHigherPriorityFirst(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+		Prioritize:      true,
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "low",
+			Num:      3,
+		},
+		{
+			RoleName: "billing",
+			Num:      4,
+			Priority: 2,
+		},
+		{
+			RoleName: "high",
+			Num:      5,
+			Priority: 1,
+		},
+	}
+
+	for j := 0; j < 10; j++ {
+		locker := talcumtest.NewLocker()
+		selector := talcum.NewSelector(talcumConfig, selectorConfig, locker)
+
+		var roles []string
+		for i := 0; i < 12; i++ {
+			entry, err := selector.Select()
+			if err != nil {
+				t.Fatal(err)
+			}
+			roles = append(roles, entry.RoleName)
+		}
+
+		for i, role := range roles {
+			expected := "low"
+			if i < 4 {
+				expected = "billing"
+			} else if i < 9 {
+				expected = "high"
+			}
+			if role != expected {
+				t.Fatalf("selection %d: expected: %s, got: %s", i, expected, role)
+			}
+		}
+	}
+}
+
+func TestSelectOverflowFail(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+		Overflow:        talcum.OverflowRandom,
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "leader",
+			Num:      1,
+			Overflow: talcum.OverflowFail,
+		},
+	}
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, talcumtest.NewLocker())
+
+	if _, err := selector.Select(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := selector.Select(); err != talcum.ErrAllSlotsTaken {
+		t.Fatalf("expected ErrAllSlotsTaken, got: %v", err)
+	}
+}
+
+func TestSelectOverflowLeavesOutEntriesThatFail(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+		Overflow:        talcum.OverflowRandom,
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "leader",
+			Num:      5,
+			Overflow: talcum.OverflowFail,
+		},
+		{
+			RoleName: "standby",
+			Num:      1,
+			Overflow: talcum.OverflowBlock,
+		},
+		{
+			RoleName: "worker",
+			Num:      1,
+		},
+	}
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, talcumtest.NewLocker())
+
+	for i := 0; i < 7; i++ {
+		if _, err := selector.Select(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		entry, err := selector.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.RoleName != "worker" {
+			t.Fatalf("expected only the worker to be duplicated, got: %s", entry.RoleName)
+		}
+	}
+}
+
+func TestSelectOverflowBlock(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+		Overflow:        talcum.OverflowBlock,
+		OverflowTimeout: 10 * time.Millisecond,
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      1,
+		},
+	}
+	locker := talcumtest.NewLocker()
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, locker)
+
+	first, err := selector.SelectSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := selector.SelectSlot(); err != talcum.ErrAllSlotsTaken {
+		t.Fatalf("expected ErrAllSlotsTaken after the timeout, got: %v", err)
+	}
+
+	talcumConfig.OverflowTimeout = 0
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		selector.Release(first.Entry, first.Slot)
+	}()
+	selection, err := selector.SelectSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selection.Random() {
+		t.Fatal("expected the freed slot to be locked")
+	}
+}
+
+func TestSelectOverflowBlockCanceled(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+		Overflow:        talcum.OverflowBlock,
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      1,
+		},
+	}
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, talcumtest.NewLocker())
+
+	if _, err := selector.Select(); err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := selector.Select()
+		errCh <- err
+	}()
+	selector.Cancel()
+	select {
+	case err := <-errCh:
+		if err != talcum.ErrCanceled {
+			t.Fatalf("expected ErrCanceled, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the blocked selection to be canceled")
+	}
+}
+
+func TestSelectOverflowLeastRecent(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+		Overflow:        talcum.OverflowLeastRecent,
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "leader",
+			Num:      1,
+			Overflow: talcum.OverflowFail,
+		},
+		{
+			RoleName: "1",
+			Num:      1,
+		},
+		{
+			RoleName: "2",
+			Num:      1,
+		},
+	}
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, talcumtest.NewLocker())
+
+	for i := 0; i < 3; i++ {
+		if _, err := selector.Select(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var last string
+	for i := 0; i < 20; i++ {
+		entry, err := selector.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.RoleName == "leader" {
+			t.Fatal("expected the leader never to be duplicated")
+		}
+		if entry.RoleName == last {
+			t.Fatalf("expected overflow to alternate, got %s twice", last)
+		}
+		last = entry.RoleName
+	}
+}
+
+func TestSelectOverflowSpare(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+		Overflow:        talcum.OverflowSpare,
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "leader",
+			Num:      1,
+		},
+		{
+			RoleName: "standby",
+			Spare:    true,
+		},
+	}
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, talcumtest.NewLocker())
+
+	entry, err := selector.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.RoleName != "leader" {
+		t.Fatalf("expected the leader slot to be locked, got: %s", entry.RoleName)
+	}
+	for i := 0; i < 5; i++ {
+		entry, err := selector.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.RoleName != "standby" {
+			t.Fatalf("expected the spare role, got: %s", entry.RoleName)
+		}
+	}
+}
+
+func TestSelectManyDistinctRoles(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+		DistinctRoles:   true,
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      2,
+		},
+		{
+			RoleName: "2",
+			Num:      1,
+		},
+		{
+			RoleName: "3",
+			Num:      3,
+		},
+	}
+	locker := talcumtest.NewLocker()
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, locker)
+
+	entries, err := selector.SelectMany(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roles []string
+	for _, entry := range entries {
+		roles = append(roles, entry.RoleName)
+	}
+	if strings.Join(roles, ",") != "1,2,3" {
+		t.Fatalf("expected every role once in configuration order, got: %v", roles)
+	}
+	if keys := locker.Keys(); len(keys) != 3 {
+		t.Fatalf("expected 3 locked keys, got: %d", len(keys))
+	}
+}
+
+func TestSelectManyStopsWhenSlotsRunOut(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      2,
+		},
+		{
+			RoleName: "2",
+			Num:      1,
+		},
+	}
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, talcumtest.NewLocker())
+
+	selections, err := selector.SelectManySlots(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selections) != 3 {
+		t.Fatalf("expected every slot to be locked, got: %d", len(selections))
+	}
+	for i, expected := range []struct {
+		role string
+		slot int
+	}{{"1", 0}, {"1", 1}, {"2", 0}} {
+		if selections[i].Entry.RoleName != expected.role || selections[i].Slot != expected.slot {
+			t.Fatalf("selection %d: expected %s/%d, got: %s/%d", i, expected.role, expected.slot,
+				selections[i].Entry.RoleName, selections[i].Slot)
+		}
+	}
+
+	selections, err = selector.SelectManySlots(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selections) != 1 || !selections[0].Random() {
+		t.Fatalf("expected a single random selection, got: %d", len(selections))
+	}
+}
+
+func TestSelectHonorsLabels(t *testing.T) {
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "gpu",
+			Num:      2,
+			Requires: map[string]string{"gpu": "true"},
+		},
+		{
+			RoleName: "ssd",
+			Num:      2,
+			Requires: map[string]string{"disk": "ssd"},
+		},
+	}
+	locker := talcumtest.NewLocker()
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+		Labels:          map[string]string{"disk": "ssd", "zone": "a"},
+	}
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, locker)
+
+	// Once the eligible slots are taken, the random fallback must
+	// not pick an ineligible role either.
+	for i := 0; i < 20; i++ {
+		entry, err := selector.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.RoleName != "ssd" {
+			t.Fatalf("selection %d: expected only the ssd role, got: %s", i, entry.RoleName)
+		}
+	}
+	if keys := locker.Keys(); len(keys) != 2 {
+		t.Fatalf("expected 2 locked keys, got: %d", len(keys))
+	}
+
+	talcumConfig.Labels = nil
+	if _, err := selector.Select(); err != talcum.ErrNotEligible {
+		t.Fatalf("expected ErrNotEligible, got: %v", err)
+	}
+}
+
+func TestSelectSpreadsAcrossZones(t *testing.T) {
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      3,
+			Zones:    2,
+		},
+		{
+			RoleName: "2",
+			Num:      3,
+		},
+	}
+	locker := talcumtest.NewLocker()
+	newSelector := func(zone string) *talcum.Selector {
+		return talcum.NewSelector(&talcum.Config{
+			ApplicationName: "test-app",
+			SelectionID:     "test-id",
+			Zone:            zone,
+		}, selectorConfig, locker)
+	}
+
+	// Zone a may hold at most ceil(3/2) = 2 slots of role 1, so
+	// the last slot is left for zone b.
+	perZone := make(map[string]int)
+	for i := 0; i < 5; i++ {
+		selection, err := newSelector("a").SelectSlot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if selection.Random() {
+			t.Fatalf("selection %d: expected a free slot to be locked", i)
+		}
+		if selection.Claim.Zone != "a" {
+			t.Fatalf("expected the zone to be claimed, got: %q", selection.Claim.Zone)
+		}
+		perZone[selection.Entry.RoleName]++
+	}
+	if perZone["1"] != 2 || perZone["2"] != 3 {
+		t.Fatalf("unexpected spread: %v", perZone)
+	}
+
+	selection, err := newSelector("b").SelectSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if selection.Random() || selection.Entry.RoleName != "1" {
+		t.Fatal("expected zone b to take the last slot of role 1")
+	}
+}
+
+func TestSelectRendezvous(t *testing.T) {
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      4,
+		},
+		{
+			RoleName: "2",
+			Num:      8,
+		},
+		{
+			RoleName: "3",
+			Num:      8,
+		},
+	}
+	var members []string
+	for i := 0; i < 10; i++ {
+		members = append(members, "host-"+strconv.Itoa(i))
+	}
+	newSelector := func(actorID string, members []string) *talcum.Selector {
+		return talcum.NewSelector(&talcum.Config{
+			ApplicationName: "test-app",
+			SelectionID:     "test-id",
+			ActorID:         actorID,
+			Members:         members,
+		}, selectorConfig, nil)
+	}
+
+	owners := func(members []string) map[string]string {
+		owners := make(map[string]string)
+		for _, member := range members {
+			selections, err := newSelector(member, members).SelectManySlots(20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(selections) != 2 {
+				t.Fatalf("member %s: expected 2 slots, got: %d", member, len(selections))
+			}
+			for _, selection := range selections {
+				slot := selection.Entry.RoleName + "/" + strconv.Itoa(selection.Slot)
+				if owner, ok := owners[slot]; ok {
+					t.Fatalf("slot %s assigned to both %s and %s", slot, owner, member)
+				}
+				owners[slot] = member
+			}
+		}
+		return owners
+	}
+
+	before := owners(members)
+	if len(before) != 20 {
+		t.Fatalf("expected every slot to be assigned, got: %d", len(before))
+	}
+
+	// Replacing a member moves the slots of the replaced one and
+	// a few more to keep the assignment balanced, rather than most
+	// slots.
+	after := owners(append(members[1:], "host-10"))
+	moved := 0
+	for slot, owner := range before {
+		if after[slot] != owner {
+			moved++
+		}
+	}
+	if moved > 6 {
+		t.Fatalf("expected at most 6 slots to move, moved: %d", moved)
+	}
+
+	if _, err := newSelector("host-99", members).SelectSlot(); err == nil {
+		t.Fatal("expected an error for an actor that is not a member")
+	}
+}
+
+func TestSelectRandomHonorsOverflowWeight(t *testing.T) {
+	zero, one := 0, 1
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName:       "low-priority",
+			Num:            10,
+			OverflowWeight: &zero,
+		},
+		{
+			RoleName:       "worker",
+			Num:            1,
+			OverflowWeight: &one,
+		},
+		{
+			RoleName: "standby",
+			Num:      0,
+		},
+	}
+	selector := talcum.NewSelector(&talcum.Config{}, selectorConfig, nil)
+
+	for i := 0; i < 100; i++ {
+		if entry := selector.SelectRandom(); entry.RoleName != "worker" {
+			t.Fatalf("expected only the worker role, got: %s", entry.RoleName)
+		}
+	}
+
+	selectorConfig[1].OverflowWeight = &zero
+	if entry := selector.SelectRandom(); entry != nil {
+		t.Fatalf("expected no entry, got: %s", entry.RoleName)
+	}
+}
+
+func TestSelectRendezvousMaxRoles(t *testing.T) {
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "A",
+			Num:      3,
+		},
+		{
+			RoleName: "B",
+			Num:      3,
+		},
+	}
+	members := []string{"host-0", "host-1", "host-2"}
+
+	// Each member takes one slot, chosen by score, so that the
+	// roles early in the configuration don't always win.
+	uncovered := 0
+	for i := 0; i < 200; i++ {
+		roles := make(map[string]bool)
+		slots := make(map[string]bool)
+		for _, member := range members {
+			selections, err := talcum.NewSelector(&talcum.Config{
+				ApplicationName: "test-app",
+				SelectionID:     strconv.Itoa(i),
+				ActorID:         member,
+				Members:         members,
+			}, selectorConfig, nil).SelectManySlots(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(selections) != 1 {
+				t.Fatalf("member %s: expected 1 slot, got: %d", member, len(selections))
+			}
+			slot := selections[0].Entry.RoleName + "/" + strconv.Itoa(selections[0].Slot)
+			if slots[slot] {
+				t.Fatalf("slot %s assigned twice", slot)
+			}
+			slots[slot] = true
+			roles[selections[0].Entry.RoleName] = true
+		}
+		if !roles["B"] {
+			uncovered++
+		}
+	}
+	if uncovered > 30 {
+		t.Fatalf("expected role B to be held in most selections, uncovered in: %d", uncovered)
+	}
+}
+
+func TestSelectDuplicable(t *testing.T) {
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "leader",
+			Num:      1,
+			Overflow: talcum.OverflowFail,
+		},
+		{
+			RoleName: "standby",
+			Num:      1,
+			Overflow: talcum.OverflowBlock,
+		},
+		{
+			RoleName: "worker",
+			Num:      1,
+		},
+	}
+	selector := talcum.NewSelector(&talcum.Config{}, selectorConfig, nil)
+
+	for i := 0; i < 100; i++ {
+		if entry := selector.SelectDuplicable(); entry.RoleName != "worker" {
+			t.Fatalf("expected only the worker role, got: %s", entry.RoleName)
+		}
+	}
+
+	selector = talcum.NewSelector(&talcum.Config{}, selectorConfig[:2], nil)
+	if entry := selector.SelectDuplicable(); entry != nil {
+		t.Fatalf("expected no entry, got: %s", entry.RoleName)
+	}
+}
+
+func TestSelectorReselect(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+	}
+	oldConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      2,
+		},
+		{
+			RoleName: "2",
+			Num:      1,
+		},
+	}
+	locker := talcumtest.NewLocker()
+	selector := talcum.NewSelector(talcumConfig, oldConfig, locker)
+	selections, err := selector.SelectManySlots(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Role 1 shrinks to a single slot and role 2 is renamed, so two
+	// selections are no longer valid.
+	newConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      1,
+		},
+		{
+			RoleName: "3",
+			Num:      2,
+		},
+	}
+	if err := newConfig.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	selector = talcum.NewSelector(talcumConfig, newConfig, locker)
+	selections, changed, err := selector.Reselect(selections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Fatal("expected the selections to change")
+	}
+
+	var got []string
+	for _, selection := range selections {
+		if !newConfig.Valid(selection) {
+			t.Fatalf("invalid selection: %s/%d", selection.Entry.RoleName, selection.Slot)
+		}
+		got = append(got, selection.Entry.RoleName+"/"+strconv.Itoa(selection.Slot))
+	}
+	if strings.Join(got, ",") != "1/0,3/0,3/1" {
+		t.Fatalf("unexpected selections: %v", got)
+	}
+	if keys := locker.Keys(); len(keys) != 3 {
+		t.Fatalf("expected the invalid slots to be released, locked keys: %d", len(keys))
+	}
+
+	if _, changed, err := selector.Reselect(selections); err != nil || changed {
+		t.Fatalf("expected valid selections to be kept: %v", err)
+	}
+}
+
+func TestSelectorRebalance(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      2,
+		},
+	}
+	locker := talcumtest.NewLocker()
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, locker)
+
+	var held []*talcum.Selection
+	for i := 0; i < 2; i++ {
+		selection, err := selector.SelectSlot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		held = append(held, selection)
+	}
+	var overflow [][]*talcum.Selection
+	for i := 0; i < 2; i++ {
+		selection, err := selector.SelectSlot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		overflow = append(overflow, []*talcum.Selection{selection})
+	}
+
+	if _, moved, err := selector.Rebalance(overflow[0], 1); err != nil || moved {
+		t.Fatalf("expected no move while every slot is taken: %v", err)
+	}
+
+	for _, selection := range held {
+		if err := selector.Release(selection.Entry, selection.Slot); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range overflow {
+		selections, moved, err := selector.Rebalance(overflow[i], 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !moved || selections[0].Random() {
+			t.Fatalf("actor %d: expected to move into a freed slot", i)
+		}
+	}
+	if keys := locker.Keys(); len(keys) != 2 {
+		t.Fatalf("expected 2 locked keys, got: %d", len(keys))
+	}
+}
+
+func TestSelectorVerifyAndReplace(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      2,
+		},
+	}
+	locker := talcumtest.NewLocker()
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, locker)
+
+	selection, err := selector.SelectSlot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := selector.Verify(selection); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another actor takes over the slot after its lock was deleted.
+	key := locker.Keys()[0]
+	locker.Expire(key)
+	if _, err := locker.Lock(key, []byte(`{"actor_id": "other"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := selector.Verify(selection); err != talcum.ErrClaimLost {
+		t.Fatalf("expected ErrClaimLost, got: %v", err)
+	}
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+	if err := selector.Watch(selection, time.Millisecond, doneCh); err != talcum.ErrClaimLost {
+		t.Fatalf("expected ErrClaimLost, got: %v", err)
+	}
+
+	selections, err := selector.Replace([]*talcum.Selection{selection}, selection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selections) != 1 || selections[0].Random() || selections[0].Slot == selection.Slot {
+		t.Fatal("expected the other slot to be claimed")
+	}
+	if err := selector.Verify(selections[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelectorConfigSelectionID(t *testing.T) {
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      2,
+		},
+	}
+	id := selectorConfig.SelectionID("")
+	if !strings.HasPrefix(selectorConfig.Hash(), id) {
+		t.Fatalf("expected selection ID derived from hash %s, got: %s", selectorConfig.Hash(), id)
+	}
+	if deployID := selectorConfig.SelectionID("deploy-7"); deployID != "deploy-7-"+id {
+		t.Fatalf("expected deploy ID to be prepended, got: %s", deployID)
+	}
+
+	changed := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      3,
+		},
+	}
+	if changed.SelectionID("") == id {
+		t.Fatal("expected a changed config to have another selection ID")
+	}
+}
+
+func TestSelectorConfigHashIgnoresRoleOrder(t *testing.T) {
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      2,
+		},
+		{
+			RoleName: "2",
+			Num:      1,
+		},
+	}
+	reordered := talcum.SelectorConfig{
+		selectorConfig[1],
+		selectorConfig[0],
+	}
+	if selectorConfig.Hash() != reordered.Hash() {
+		t.Fatal("expected reordered roles to have the same hash")
+	}
+	if selectorConfig[0].RoleName != "1" {
+		t.Fatal("expected the config not to be reordered")
+	}
+}
+
+func TestSelectorReleaseClaim(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+		ActorID:         "actor-1",
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      2,
+		},
+	}
+	locker := talcumtest.NewLocker()
+	selector := talcum.NewSelector(talcumConfig, selectorConfig, locker)
+
+	selections, err := selector.SelectManySlots(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first slot expires and is claimed by another actor.
+	key := locker.Keys()[0]
+	locker.Expire(key)
+	other := talcum.NewSelector(&talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+		ActorID:         "actor-2",
+	}, selectorConfig, locker)
+	if _, err := other.SelectSlot(); err != nil {
+		t.Fatal(err)
+	}
+
+	held, err := selector.Held("actor-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(held) != 1 {
+		t.Fatalf("expected one slot held by actor-1, got: %d", len(held))
+	}
+
+	for _, selection := range selections {
+		err := selector.ReleaseClaim(selection)
+		if selection.Slot == held[0].Slot && err != nil {
+			t.Fatal(err)
+		}
+		if selection.Slot != held[0].Slot && err != talcum.ErrClaimLost {
+			t.Fatalf("expected ErrClaimLost, got: %v", err)
+		}
+	}
+	if keys := locker.Keys(); len(keys) != 1 || keys[0] != key {
+		t.Fatalf("expected only the slot of actor-2 to stay locked, got: %v", keys)
+	}
+}
@@ -0,0 +1,110 @@
+package talcum
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrClaimLost is returned when the slot of a selection is no longer
+// locked with the selection's claim, e.g. because the lock was
+// deleted by an operator or expired.
+var ErrClaimLost = errors.New("claim lost")
+
+// Watcher is implemented by lockers that can watch a lock. Watch
+// blocks until the lock of key no longer has value, returning false,
+// or until doneCh is closed, returning true.
+type Watcher interface {
+	Watch(key string, value []byte, doneCh chan struct{}) (bool, error)
+}
+
+// sameClaim returns true if two claims were made by the same claim
+// operation.
+func sameClaim(a, b *Claim) bool {
+	return a.ActorID == b.ActorID &&
+		a.Hostname == b.Hostname &&
+		a.PID == b.PID &&
+		a.RoleName == b.RoleName &&
+		a.Slot == b.Slot &&
+		a.ClaimedAt.Equal(b.ClaimedAt)
+}
+
+// Verify returns ErrClaimLost if the slot of a selection is no longer
+// locked with the selection's claim. Selections without a claim,
+// e.g. because they were chosen randomly, hold no lock and are always
+// verified.
+func (s *Selector) Verify(selection *Selection) error {
+	if selection.Claim == nil {
+		return nil
+	}
+
+	value, err := s.locker.Get(s.lockKey(selection.Entry, selection.Slot))
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		return ErrClaimLost
+	}
+	claim, err := ParseClaim(value)
+	if err != nil || !sameClaim(claim, selection.Claim) {
+		return ErrClaimLost
+	}
+	return nil
+}
+
+// Watch blocks until the claim of a selection is lost, returning
+// ErrClaimLost, or until doneCh is closed, returning nil. Lockers that
+// are Watchers are notified of the loss by their backend, while the
+// claims of other lockers are verified every interval.
+func (s *Selector) Watch(selection *Selection, interval time.Duration, doneCh chan struct{}) error {
+	if selection.Claim == nil {
+		<-doneCh
+		return nil
+	}
+
+	if watcher, ok := s.locker.(Watcher); ok {
+		value, err := json.Marshal(selection.Claim)
+		if err != nil {
+			return err
+		}
+		held, err := watcher.Watch(s.lockKey(selection.Entry, selection.Slot), value, doneCh)
+		if err != nil {
+			return err
+		}
+		if !held {
+			return ErrClaimLost
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case <-time.After(interval):
+			if err := s.Verify(selection); err != nil {
+				return err
+			}
+		case <-doneCh:
+			return nil
+		}
+	}
+}
+
+// Replace drops the selections whose claims were lost and locks other
+// slots in their place, the same way SelectManySlots does.
+func (s *Selector) Replace(selections []*Selection, lost ...*Selection) ([]*Selection, error) {
+	if len(s.talcumConfig.Members) > 0 {
+		return selections, nil
+	}
+
+	dropped := make(map[*Selection]bool)
+	for _, selection := range lost {
+		dropped[selection] = true
+	}
+	var kept []*Selection
+	for _, selection := range selections {
+		if !dropped[selection] {
+			kept = append(kept, selection)
+		}
+	}
+	return s.selectMany(len(selections), kept)
+}
@@ -0,0 +1,93 @@
+package talcum
+
+import (
+	"path"
+	"strings"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// ZooKeeperConn is the interface to a ZooKeeper connection.
+type ZooKeeperConn interface {
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	Delete(path string, version int32) error
+}
+
+// ZooKeeperLocker can lock keys using ZooKeeper as a backend. Locks
+// are ephemeral znodes, so they are deleted when the session of the
+// connection that created them ends, e.g. when the process holding
+// the connection exits.
+type ZooKeeperLocker struct {
+	conn ZooKeeperConn
+	root string
+	acl  []zk.ACL
+}
+
+// NewZooKeeperLocker creates a new ZooKeeperLocker that creates
+// znodes below root.
+func NewZooKeeperLocker(conn ZooKeeperConn, root string) *ZooKeeperLocker {
+	return &ZooKeeperLocker{
+		conn: conn,
+		root: root,
+		acl:  zk.WorldACL(zk.PermAll),
+	}
+}
+
+func (z *ZooKeeperLocker) path(key string) string {
+	return path.Join("/", z.root, key)
+}
+
+// Lock tries to lock a key, storing value in it, return true if the
+// lock operation was successful.
+func (z *ZooKeeperLocker) Lock(key string, value []byte) (bool, error) {
+	p := z.path(key)
+	if err := z.createParents(p); err != nil {
+		return false, err
+	}
+
+	_, err := z.conn.Create(p, value, zk.FlagEphemeral, z.acl)
+	if err == zk.ErrNodeExists {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// createParents creates the persistent parent znodes of p. Ephemeral
+// znodes can't have children, so the parents can't be ephemeral.
+func (z *ZooKeeperLocker) createParents(p string) error {
+	parts := strings.Split(strings.Trim(path.Dir(p), "/"), "/")
+	parent := ""
+	for _, part := range parts {
+		if part == "" {
+			continue
+		}
+		parent += "/" + part
+		_, err := z.conn.Create(parent, nil, 0, z.acl)
+		if err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the value of a key or nil if it is not locked.
+func (z *ZooKeeperLocker) Get(key string) ([]byte, error) {
+	value, _, err := z.conn.Get(z.path(key))
+	if err == zk.ErrNoNode {
+		return nil, nil
+	}
+	return value, err
+}
+
+// Unlock releases a key by deleting its znode.
+func (z *ZooKeeperLocker) Unlock(key string) error {
+	err := z.conn.Delete(z.path(key), -1)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	return err
+}
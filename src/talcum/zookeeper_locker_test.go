@@ -0,0 +1,90 @@
+package talcum_test
+
+import (
+	"testing"
+
+	"github.com/dollarshaveclub/talcum/src/talcum"
+	"github.com/go-zookeeper/zk"
+)
+
+type mockZooKeeperConn struct {
+	znodes map[string]int32
+	data   map[string][]byte
+}
+
+func newMockZooKeeperConn() *mockZooKeeperConn {
+	return &mockZooKeeperConn{
+		znodes: make(map[string]int32),
+		data:   make(map[string][]byte),
+	}
+}
+
+func (m *mockZooKeeperConn) Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	if _, ok := m.znodes[path]; ok {
+		return "", zk.ErrNodeExists
+	}
+	m.znodes[path] = flags
+	m.data[path] = data
+	return path, nil
+}
+
+func (m *mockZooKeeperConn) Get(path string) ([]byte, *zk.Stat, error) {
+	if _, ok := m.znodes[path]; !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	return m.data[path], &zk.Stat{}, nil
+}
+
+func (m *mockZooKeeperConn) Delete(path string, version int32) error {
+	if _, ok := m.znodes[path]; !ok {
+		return zk.ErrNoNode
+	}
+	delete(m.znodes, path)
+	return nil
+}
+
+func TestZooKeeperLocker(t *testing.T) {
+	conn := newMockZooKeeperConn()
+	locker := talcum.NewZooKeeperLocker(conn, "talcum")
+
+	locked, err := locker.Lock("app/1/abc/0", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected key to be locked")
+	}
+	if flags, ok := conn.znodes["/talcum/app/1/abc/0"]; !ok || flags != zk.FlagEphemeral {
+		t.Fatalf("expected an ephemeral znode, got: %v", conn.znodes)
+	}
+	for _, parent := range []string{"/talcum", "/talcum/app", "/talcum/app/1", "/talcum/app/1/abc"} {
+		if flags, ok := conn.znodes[parent]; !ok || flags != 0 {
+			t.Fatalf("expected a persistent parent znode: %s", parent)
+		}
+	}
+
+	locked, err = locker.Lock("app/1/abc/0", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked {
+		t.Fatal("expected locked key to stay locked")
+	}
+	if value, err := locker.Get("app/1/abc/0"); err != nil || string(value) != "1" {
+		t.Fatalf("unexpected value: %s, %v", value, err)
+	}
+
+	if err := locker.Unlock("app/1/abc/0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := locker.Unlock("app/1/abc/0"); err != nil {
+		t.Fatal(err)
+	}
+	locked, err = locker.Lock("app/1/abc/0", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("expected unlocked key to be lockable")
+	}
+}
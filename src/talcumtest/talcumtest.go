@@ -0,0 +1,195 @@
+// Package talcumtest provides an in-memory Locker and helpers for
+// testing code that uses talcum.
+package talcumtest
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/talcum/src/talcum"
+)
+
+type lock struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// Locker is an in-memory talcum.Locker that is safe for concurrent
+// use. Locks can be made to expire by setting a TTL and advancing the
+// locker's clock, and errors can be injected with FailNext.
+type Locker struct {
+	mu       sync.Mutex
+	locks    map[string]*lock
+	ttl      time.Duration
+	now      time.Time
+	failures []error
+}
+
+// NewLocker creates a new Locker whose locks never expire.
+func NewLocker() *Locker {
+	return &Locker{
+		locks: make(map[string]*lock),
+		now:   time.Now(),
+	}
+}
+
+// SetTTL makes locks set from now on expire after ttl. A ttl of zero
+// disables expiry.
+func (l *Locker) SetTTL(ttl time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ttl = ttl
+}
+
+// Advance moves the locker's clock forward, expiring any locks whose
+// TTL has passed.
+func (l *Locker) Advance(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.now = l.now.Add(d)
+}
+
+// Expire immediately expires a lock, as if its holder had died.
+func (l *Locker) Expire(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.locks, key)
+}
+
+// FailNext makes the next Lock, Unlock or Get calls return the given
+// errors, one per call.
+func (l *Locker) FailNext(errs ...error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failures = append(l.failures, errs...)
+}
+
+// Lock tries to lock a key, storing value in it, return true if the
+// lock operation was successful.
+func (l *Locker) Lock(key string, value []byte) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.failure(); err != nil {
+		return false, err
+	}
+	if _, ok := l.get(key); ok {
+		return false, nil
+	}
+
+	lk := &lock{value: value}
+	if l.ttl > 0 {
+		lk.expiresAt = l.now.Add(l.ttl)
+	}
+	l.locks[key] = lk
+	return true, nil
+}
+
+// Unlock releases a key.
+func (l *Locker) Unlock(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.failure(); err != nil {
+		return err
+	}
+	delete(l.locks, key)
+	return nil
+}
+
+// Get returns the value of a lock or nil if it is not set.
+func (l *Locker) Get(key string) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := l.failure(); err != nil {
+		return nil, err
+	}
+	lk, ok := l.get(key)
+	if !ok {
+		return nil, nil
+	}
+	return lk.value, nil
+}
+
+// Value returns the value of a lock and whether it is set.
+func (l *Locker) Value(key string) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lk, ok := l.get(key)
+	if !ok {
+		return nil, false
+	}
+	return lk.value, true
+}
+
+// Keys returns the sorted keys of all locks that are set.
+func (l *Locker) Keys() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var keys []string
+	for key := range l.locks {
+		if _, ok := l.get(key); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// get returns a lock if it is set and has not expired. It must be
+// called with l.mu held.
+func (l *Locker) get(key string) (*lock, bool) {
+	lk, ok := l.locks[key]
+	if !ok {
+		return nil, false
+	}
+	if !lk.expiresAt.IsZero() && !l.now.Before(lk.expiresAt) {
+		delete(l.locks, key)
+		return nil, false
+	}
+	return lk, true
+}
+
+// failure pops the next injected error. It must be called with l.mu
+// held.
+func (l *Locker) failure() error {
+	if len(l.failures) == 0 {
+		return nil
+	}
+	err := l.failures[0]
+	l.failures = l.failures[1:]
+	return err
+}
+
+// AssertHonorsNum fails the test if a set of selections does not
+// honor the Num of each entry: no role may be selected more than its
+// Num times until every slot is taken, and once every slot is taken
+// each role must have been selected at least Num times.
+func AssertHonorsNum(t testing.TB, config talcum.SelectorConfig, selections []*talcum.SelectorEntry) {
+	t.Helper()
+
+	slots := 0
+	for _, entry := range config {
+		slots += entry.Num
+	}
+
+	seen := make(map[string]int)
+	for _, entry := range selections {
+		seen[entry.RoleName]++
+	}
+
+	for _, entry := range config {
+		numSeen := seen[entry.RoleName]
+		if len(selections) <= slots && numSeen > entry.Num {
+			t.Errorf("role %s: expected at most: %d, seen: %d", entry.RoleName, entry.Num, numSeen)
+		}
+		if len(selections) >= slots && numSeen < entry.Num {
+			t.Errorf("role %s: expected at least: %d, seen: %d", entry.RoleName, entry.Num, numSeen)
+		}
+	}
+}
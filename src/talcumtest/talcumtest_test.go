@@ -0,0 +1,91 @@
+package talcumtest_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dollarshaveclub/talcum/src/talcum"
+	"github.com/dollarshaveclub/talcum/src/talcumtest"
+)
+
+func TestLockerExpiry(t *testing.T) {
+	locker := talcumtest.NewLocker()
+	locker.SetTTL(time.Minute)
+
+	locked, err := locker.Lock("a", []byte("1"))
+	if err != nil || !locked {
+		t.Fatalf("expected key to be locked: %v", err)
+	}
+
+	locker.Advance(30 * time.Second)
+	if _, ok := locker.Value("a"); !ok {
+		t.Fatal("expected key to still be locked")
+	}
+
+	locker.Advance(30 * time.Second)
+	if _, ok := locker.Value("a"); ok {
+		t.Fatal("expected key to have expired")
+	}
+	locked, err = locker.Lock("a", []byte("2"))
+	if err != nil || !locked {
+		t.Fatalf("expected expired key to be lockable: %v", err)
+	}
+}
+
+func TestLockerFailNext(t *testing.T) {
+	locker := talcumtest.NewLocker()
+	errLock := errors.New("lock failed")
+	locker.FailNext(errLock)
+
+	if _, err := locker.Lock("a", []byte("1")); err != errLock {
+		t.Fatalf("expected injected error, got: %v", err)
+	}
+	if locked, err := locker.Lock("a", []byte("1")); err != nil || !locked {
+		t.Fatalf("expected key to be locked: %v", err)
+	}
+}
+
+func TestConcurrentSelect(t *testing.T) {
+	talcumConfig := &talcum.Config{
+		ApplicationName: "test-app",
+		SelectionID:     "test-id",
+	}
+	selectorConfig := talcum.SelectorConfig{
+		{
+			RoleName: "1",
+			Num:      3,
+		},
+		{
+			RoleName: "2",
+			Num:      5,
+		},
+	}
+	locker := talcumtest.NewLocker()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var selections []*talcum.SelectorEntry
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			selector := talcum.NewSelector(talcumConfig, selectorConfig, locker)
+			entry, err := selector.Select()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			selections = append(selections, entry)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	talcumtest.AssertHonorsNum(t, selectorConfig, selections)
+	if keys := locker.Keys(); len(keys) != 8 {
+		t.Fatalf("expected 8 locked keys, got: %d", len(keys))
+	}
+}